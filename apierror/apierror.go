@@ -0,0 +1,139 @@
+// Package apierror defines the errors handlers return to clients and renders
+// them as RFC 7807 problem details.
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// MIMEProblemJSON is the content type of every error response.
+const MIMEProblemJSON = "application/problem+json"
+
+// StatusClientClosedRequest is the non-standard status, borrowed from nginx,
+// of a request the client gave up on before it was answered. The client never
+// sees it; it is there for logs and metrics.
+const StatusClientClosedRequest = 499
+
+// Code is a stable, machine readable error identifier. Clients branch on it
+// rather than on the detail message, which may change.
+type Code string
+
+const (
+	CodeBadRequest           Code = "BAD_REQUEST"
+	CodeInvalidFilter        Code = "INVALID_FILTER"
+	CodeUnauthorized         Code = "UNAUTHORIZED"
+	CodeForbidden            Code = "FORBIDDEN"
+	CodeNotFound             Code = "NOT_FOUND"
+	CodeExpenseNotFound      Code = "EXPENSE_NOT_FOUND"
+	CodeMethodNotAllowed     Code = "METHOD_NOT_ALLOWED"
+	CodeConflict             Code = "CONFLICT"
+	CodePreconditionFailed   Code = "PRECONDITION_FAILED"
+	CodePayloadTooLarge      Code = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMediaType Code = "UNSUPPORTED_MEDIA_TYPE"
+	CodeValidationFailed     Code = "VALIDATION_FAILED"
+	CodeIdempotencyKeyReused Code = "IDEMPOTENCY_KEY_REUSED"
+	CodeBatchAborted         Code = "BATCH_ABORTED"
+	CodeTooManyRequests      Code = "TOO_MANY_REQUESTS"
+	CodeClientClosedRequest  Code = "CLIENT_CLOSED_REQUEST"
+	CodeInternal             Code = "INTERNAL"
+	CodeUnavailable          Code = "SERVICE_UNAVAILABLE"
+	CodeDatabaseTimeout      Code = "DATABASE_TIMEOUT"
+)
+
+// statusCodes is the code used for an error that only carries an HTTP status.
+var statusCodes = map[int]Code{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusPreconditionFailed:    CodePreconditionFailed,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	http.StatusUnprocessableEntity:   CodeValidationFailed,
+	http.StatusTooManyRequests:       CodeTooManyRequests,
+	StatusClientClosedRequest:        CodeClientClosedRequest,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// StatusText is http.StatusText extended with StatusClientClosedRequest.
+func StatusText(status int) string {
+	if status == StatusClientClosedRequest {
+		return "Client Closed Request"
+	}
+	return http.StatusText(status)
+}
+
+// CodeFor returns the generic code of an HTTP status.
+func CodeFor(status int) Code {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// Error is an error meant for the client. Detail and Errors are sent in the
+// response; Err is the underlying cause and is only logged.
+type Error struct {
+	Status int
+	Code   Code
+	Detail string
+	// Errors lists per-field or per-item problems, sent as the "errors" member.
+	Errors interface{}
+	Err    error
+}
+
+func New(status int, code Code, detail string) *Error {
+	return &Error{Status: status, Code: code, Detail: detail}
+}
+
+func Newf(status int, code Code, format string, a ...interface{}) *Error {
+	return New(status, code, fmt.Sprintf(format, a...))
+}
+
+func BadRequest(detail string) *Error {
+	return New(http.StatusBadRequest, CodeBadRequest, detail)
+}
+
+// Internal hides err behind a generic message.
+func Internal(err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Detail: "internal server error", Err: err}
+}
+
+// WithErrors sets the "errors" member of the response.
+func (e *Error) WithErrors(errs interface{}) *Error {
+	e.Errors = errs
+	return e
+}
+
+// Wrap records err as the cause without exposing it.
+func (e *Error) Wrap(err error) *Error {
+	e.Err = err
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %s", e.Code, e.Detail, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Detail)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// From returns err as an *Error, treating anything unknown as internal.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Internal(err)
+}
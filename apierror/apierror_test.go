@@ -0,0 +1,83 @@
+//go:build unit
+// +build unit
+
+package apierror
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPErrorHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		err            error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "TestAPIError",
+			err:            New(http.StatusNotFound, CodeExpenseNotFound, "expense not found with given id"),
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `{"type":"about:blank","title":"Not Found","status":404,"detail":"expense not found with given id","instance":"/expenses/1","code":"EXPENSE_NOT_FOUND"}`,
+		},
+		{
+			name:           "TestAPIErrorWithErrors",
+			err:            New(http.StatusUnprocessableEntity, CodeValidationFailed, "expense is invalid").WithErrors([]string{"title is required"}),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedBody:   `{"type":"about:blank","title":"Unprocessable Entity","status":422,"detail":"expense is invalid","instance":"/expenses/1","code":"VALIDATION_FAILED","errors":["title is required"]}`,
+		},
+		{
+			name:           "TestEchoError",
+			err:            echo.ErrMethodNotAllowed,
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   `{"type":"about:blank","title":"Method Not Allowed","status":405,"detail":"Method Not Allowed","instance":"/expenses/1","code":"METHOD_NOT_ALLOWED"}`,
+		},
+		{
+			name:           "TestUnknownErrorIsHidden",
+			err:            errors.New(`pq: relation "expenses" does not exist`),
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   `{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"internal server error","instance":"/expenses/1","code":"INTERNAL"}`,
+		},
+		{
+			name:           "TestWrappedCauseIsHidden",
+			err:            BadRequest("id should be int").Wrap(errors.New(`strconv.Atoi: parsing "x"`)),
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"type":"about:blank","title":"Bad Request","status":400,"detail":"id should be int","instance":"/expenses/1","code":"BAD_REQUEST"}`,
+		},
+		{
+			name:           "TestHead",
+			method:         http.MethodHead,
+			err:            New(http.StatusNotFound, CodeExpenseNotFound, "expense not found with given id"),
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			e := echo.New()
+			e.Logger.SetOutput(io.Discard)
+			req := httptest.NewRequest(method, "/expenses/1", nil)
+			rec := httptest.NewRecorder()
+
+			HTTPErrorHandler(test.err, e.NewContext(req, rec))
+
+			assert.Equal(t, test.expectedStatus, rec.Code)
+			assert.Equal(t, test.expectedBody, rec.Body.String())
+			if test.expectedBody != "" {
+				assert.Equal(t, MIMEProblemJSON, rec.Header().Get(echo.HeaderContentType))
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/logging"
+)
+
+// Problem is the RFC 7807 response body, extended with the error code and
+// optional per-field errors.
+type Problem struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Detail   string      `json:"detail,omitempty"`
+	Instance string      `json:"instance,omitempty"`
+	Code     Code        `json:"code"`
+	Errors   interface{} `json:"errors,omitempty"`
+}
+
+// HTTPErrorHandler is the echo error handler. It renders *Error and echo's
+// own errors as problem details and logs the cause of server errors.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	e := fromEcho(err)
+	if e.Status >= http.StatusInternalServerError {
+		logging.FromContext(c.Request().Context()).Error("request failed", "code", e.Code, "error", e)
+	}
+
+	p := Problem{
+		Type:     "about:blank",
+		Title:    StatusText(e.Status),
+		Status:   e.Status,
+		Detail:   e.Detail,
+		Instance: c.Request().URL.Path,
+		Code:     e.Code,
+		Errors:   e.Errors,
+	}
+
+	var werr error
+	if c.Request().Method == http.MethodHead {
+		werr = c.NoContent(e.Status)
+	} else {
+		b, _ := json.Marshal(p)
+		werr = c.Blob(e.Status, MIMEProblemJSON, b)
+	}
+	if werr != nil {
+		logging.FromContext(c.Request().Context()).Error("writing error response failed", "error", werr)
+	}
+}
+
+// Status returns the status HTTPErrorHandler responds to err with.
+func Status(err error) int {
+	return fromEcho(err).Status
+}
+
+// fromEcho also converts the *echo.HTTPError returned by routing, binding and
+// echo's middleware. Their message is kept for client errors only.
+func fromEcho(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var he *echo.HTTPError
+	if !errors.As(err, &he) || he.Code >= http.StatusInternalServerError {
+		return Internal(err)
+	}
+	detail := http.StatusText(he.Code)
+	if he.Message != nil {
+		detail = fmt.Sprint(he.Message)
+	}
+	return &Error{Status: he.Code, Code: CodeFor(he.Code), Detail: detail, Err: he.Internal}
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyAuthenticator accepts static keys sent in the X-API-Key header. Only
+// the SHA-256 hash of each key is stored in the api_keys table.
+type APIKeyAuthenticator struct {
+	DB *sql.DB
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	p := &Principal{Method: "api_key"}
+	row := a.DB.QueryRowContext(r.Context(), "SELECT subject, roles FROM api_keys WHERE key_hash=$1 AND revoked_at IS NULL", HashAPIKey(key))
+	err := row.Scan(&p.Subject, pq.Array(&p.Roles))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't look up api key: %w", err)
+	}
+	return p, nil
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ContextKey is the echo context key holding the authenticated *Principal.
+const ContextKey = "principal"
+
+const RoleAdmin = "admin"
+
+var (
+	// ErrNoCredentials means the request carries no credentials this
+	// authenticator understands, so the next one should be tried.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials means the credentials were recognised but rejected.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is the caller a request was authenticated as.
+type Principal struct {
+	Subject string
+	Roles   []string
+	// Method names the authenticator that accepted the request, e.g. "jwt".
+	Method string
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// FromContext returns the principal set by the authentication middleware.
+func FromContext(c echo.Context) (*Principal, bool) {
+	p, ok := c.Get(ContextKey).(*Principal)
+	return p, ok
+}
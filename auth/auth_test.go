@@ -0,0 +1,155 @@
+//go:build unit
+// +build unit
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func bearer(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/expenses", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	secret := []byte("top-secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &JWTAuthenticator{
+		Keys:     KeySet{"hs": secret, "rs": &rsaKey.PublicKey},
+		Issuer:   "assessment",
+		Audience: "expenses",
+	}
+	valid := Claims{
+		Roles: []string{"admin"},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "user-1",
+			Issuer:    "assessment",
+			Audience:  jwt.ClaimStrings{"reports", "expenses"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	expired := valid
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	noExpiry := valid
+	noExpiry.ExpiresAt = nil
+	otherIssuer := valid
+	otherIssuer.Issuer = "someone-else"
+	otherAudience := valid
+	otherAudience.Audience = jwt.ClaimStrings{"reports"}
+
+	tests := []struct {
+		name        string
+		req         *http.Request
+		expectedErr error
+	}{
+		{name: "TestJWTValidHS256", req: bearer(sign(t, jwt.SigningMethodHS256, "hs", secret, valid))},
+		{name: "TestJWTValidRS256", req: bearer(sign(t, jwt.SigningMethodRS256, "rs", rsaKey, valid))},
+		{name: "TestJWTNoHeader", req: httptest.NewRequest(http.MethodGet, "/expenses", nil), expectedErr: ErrNoCredentials},
+		{name: "TestJWTExpired", req: bearer(sign(t, jwt.SigningMethodHS256, "hs", secret, expired)), expectedErr: ErrInvalidCredentials},
+		{name: "TestJWTNoExpiry", req: bearer(sign(t, jwt.SigningMethodHS256, "hs", secret, noExpiry)), expectedErr: ErrInvalidCredentials},
+		{name: "TestJWTWrongIssuer", req: bearer(sign(t, jwt.SigningMethodHS256, "hs", secret, otherIssuer)), expectedErr: ErrInvalidCredentials},
+		{name: "TestJWTWrongAudience", req: bearer(sign(t, jwt.SigningMethodHS256, "hs", secret, otherAudience)), expectedErr: ErrInvalidCredentials},
+		{name: "TestJWTWrongSecret", req: bearer(sign(t, jwt.SigningMethodHS256, "hs", []byte("guess"), valid)), expectedErr: ErrInvalidCredentials},
+		{name: "TestJWTUnknownKid", req: bearer(sign(t, jwt.SigningMethodHS256, "nope", secret, valid)), expectedErr: ErrInvalidCredentials},
+		{name: "TestJWTAlgorithmMismatch", req: bearer(sign(t, jwt.SigningMethodHS256, "rs", secret, valid)), expectedErr: ErrInvalidCredentials},
+		{name: "TestJWTGarbage", req: bearer("not.a.token"), expectedErr: ErrInvalidCredentials},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := a.Authenticate(test.req)
+			if test.expectedErr != nil {
+				assert.True(t, errors.Is(err, test.expectedErr), "got %v", err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, "user-1", p.Subject)
+				assert.True(t, p.HasRole(RoleAdmin))
+				assert.Equal(t, "jwt", p.Method)
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         string
+		mockRows    *sqlmock.Rows
+		expectedErr error
+	}{
+		{
+			name:     "TestAPIKeyValid",
+			key:      "k-123",
+			mockRows: sqlmock.NewRows([]string{"subject", "roles"}).AddRow("service-a", pq.Array([]string{"admin"})),
+		},
+		{
+			name:        "TestAPIKeyUnknown",
+			key:         "k-123",
+			mockRows:    sqlmock.NewRows([]string{"subject", "roles"}),
+			expectedErr: ErrInvalidCredentials,
+		},
+		{
+			name:        "TestAPIKeyMissing",
+			expectedErr: ErrNoCredentials,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			if test.mockRows != nil {
+				mock.ExpectQuery("SELECT subject, roles FROM api_keys WHERE key_hash=\\$1 AND revoked_at IS NULL").
+					WithArgs(HashAPIKey(test.key)).WillReturnRows(test.mockRows)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/expenses", nil)
+			if test.key != "" {
+				req.Header.Set(APIKeyHeader, test.key)
+			}
+
+			a := &APIKeyAuthenticator{DB: db}
+			p, err := a.Authenticate(req)
+			if test.expectedErr != nil {
+				assert.Equal(t, test.expectedErr, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, "service-a", p.Subject)
+				assert.Equal(t, []string{"admin"}, p.Roles)
+			}
+		})
+	}
+}
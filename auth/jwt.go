@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// KeySet maps a key id to an HS256 secret ([]byte) or an RS256 public key
+// (*rsa.PublicKey). A token's kid header selects the key; tokens without one
+// are only accepted when the set holds a single key.
+type KeySet map[string]interface{}
+
+// LoadKeySet reads every <kid>.pem file in dir as an RS256 public key and every
+// <kid>.secret file as an HS256 secret.
+func LoadKeySet(dir string) (KeySet, error) {
+	keys := KeySet{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		kid := strings.TrimSuffix(name, ext)
+		if entry.IsDir() || (ext != ".pem" && ext != ".secret") {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if ext == ".secret" {
+			keys[kid] = []byte(strings.TrimSpace(string(b)))
+			continue
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse key %s: %w", name, err)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+// Claims are the registered claims plus the caller's roles. The audience may
+// be a single string or an array, as RFC 7519 allows.
+type Claims struct {
+	Roles []string `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// JWTAuthenticator accepts "Authorization: Bearer <token>" signed with HS256
+// or RS256 by a key of its key set. Tokens must expire, so one without an exp
+// claim is rejected.
+type JWTAuthenticator struct {
+	Keys KeySet
+	// Issuer and Audience are checked when set.
+	Issuer   string
+	Audience string
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(header, "Bearer "), claims, a.keyFunc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCredentials, err)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidCredentials)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: token has no expiry", ErrInvalidCredentials)
+	}
+	if a.Issuer != "" && !claims.VerifyIssuer(a.Issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidCredentials)
+	}
+	if a.Audience != "" && !claims.VerifyAudience(a.Audience, true) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidCredentials)
+	}
+
+	return &Principal{Subject: claims.Subject, Roles: claims.Roles, Method: "jwt"}, nil
+}
+
+// keyFunc picks the verification key and makes sure the token's algorithm
+// matches its type, so an RSA public key can never be used as an HMAC secret.
+func (a *JWTAuthenticator) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := a.Keys[kid]
+	if kid == "" && len(a.Keys) == 1 {
+		for _, k := range a.Keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	switch key.(type) {
+	case []byte:
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+	case *rsa.PublicKey:
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return key, nil
+}
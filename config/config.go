@@ -0,0 +1,354 @@
+// Package config loads the server settings from defaults, an optional YAML or
+// TOML file, the environment and command line flags, in increasing order of
+// precedence.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/teerit/assessment/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvFile names the environment variable that can point at the config file
+// instead of the -config flag.
+const EnvFile = "CONFIG_FILE"
+
+const (
+	AuthAPIKey = "apikey"
+	AuthJWT    = "jwt"
+	AuthBoth   = "both"
+)
+
+type Config struct {
+	Server   Server   `yaml:"server" toml:"server"`
+	TLS      TLS      `yaml:"tls" toml:"tls"`
+	CORS     CORS     `yaml:"cors" toml:"cors"`
+	Database Database `yaml:"database" toml:"database"`
+	Auth     Auth     `yaml:"auth" toml:"auth"`
+	Log      Log      `yaml:"log" toml:"log"`
+	Metrics  Metrics  `yaml:"metrics" toml:"metrics"`
+	Tracing  Tracing  `yaml:"tracing" toml:"tracing"`
+	Expenses Expenses `yaml:"expenses" toml:"expenses"`
+}
+
+type Server struct {
+	Port            int      `yaml:"port" toml:"port"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// ReadyTimeout bounds the checks of one readiness probe.
+	ReadyTimeout Duration `yaml:"ready_timeout" toml:"ready_timeout"`
+}
+
+// TLS is enabled when both files are set.
+type TLS struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+}
+
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// CORS is disabled when no origin is allowed.
+type CORS struct {
+	AllowOrigins []string `yaml:"allow_origins" toml:"allow_origins"`
+}
+
+type Database struct {
+	URL             string   `yaml:"url" toml:"url"`
+	MaxOpenConns    int      `yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int      `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	// StatementTimeout bounds every call to the expense stores.
+	StatementTimeout Duration `yaml:"statement_timeout" toml:"statement_timeout"`
+}
+
+type Auth struct {
+	// Mode is AuthAPIKey, AuthJWT or AuthBoth.
+	Mode        string `yaml:"mode" toml:"mode"`
+	JWTKeysDir  string `yaml:"jwt_keys_dir" toml:"jwt_keys_dir"`
+	JWTIssuer   string `yaml:"jwt_issuer" toml:"jwt_issuer"`
+	JWTAudience string `yaml:"jwt_audience" toml:"jwt_audience"`
+}
+
+type Log struct {
+	Level string `yaml:"level" toml:"level"`
+}
+
+// Metrics are served on /metrics only when Token is set.
+type Metrics struct {
+	Token string `yaml:"token" toml:"token"`
+}
+
+type Tracing struct {
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	File     string `yaml:"file" toml:"file"`
+}
+
+type Expenses struct {
+	TrashRetention Duration `yaml:"trash_retention" toml:"trash_retention"`
+	IdempotencyTTL Duration `yaml:"idempotency_ttl" toml:"idempotency_ttl"`
+}
+
+// Default returns the settings used for anything not configured.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:            2565,
+			ShutdownTimeout: Duration(5 * time.Second),
+			ReadyTimeout:    Duration(2 * time.Second),
+		},
+		Database: Database{
+			MaxOpenConns:     20,
+			MaxIdleConns:     10,
+			ConnMaxLifetime:  Duration(30 * time.Minute),
+			StatementTimeout: Duration(5 * time.Second),
+		},
+		Auth:    Auth{Mode: AuthAPIKey},
+		Log:     Log{Level: "info"},
+		Tracing: Tracing{Exporter: "none"},
+		Expenses: Expenses{
+			TrashRetention: Duration(30 * 24 * time.Hour),
+			IdempotencyTTL: Duration(24 * time.Hour),
+		},
+	}
+}
+
+// Options are the command line flags that aren't settings.
+type Options struct {
+	File        string
+	PrintConfig bool
+	// Args are the arguments left after the flags.
+	Args []string
+}
+
+// setting ties a flag to the environment variable that can also set it.
+type setting struct {
+	flag, env string
+}
+
+// bind registers a flag for every setting of c, with c's values as defaults.
+func (c *Config) bind(fs *flag.FlagSet) []setting {
+	settings := []setting{}
+	add := func(v flag.Value, name, env, usage string) {
+		fs.Var(v, name, usage+" ($"+env+")")
+		settings = append(settings, setting{name, env})
+	}
+
+	add((*intValue)(&c.Server.Port), "port", "PORT", "port to listen on")
+	add(&c.Server.ShutdownTimeout, "shutdown-timeout", "SHUTDOWN_TIMEOUT", "time allowed for in-flight requests on shutdown")
+	add(&c.Server.ReadyTimeout, "ready-timeout", "READY_TIMEOUT", "time allowed for the checks of /readyz")
+	add((*stringValue)(&c.TLS.CertFile), "tls-cert-file", "TLS_CERT_FILE", "PEM certificate to serve HTTPS with")
+	add((*stringValue)(&c.TLS.KeyFile), "tls-key-file", "TLS_KEY_FILE", "PEM private key of the certificate")
+	add((*listValue)(&c.CORS.AllowOrigins), "cors-allow-origins", "CORS_ALLOW_ORIGINS", "comma separated origins allowed to call the API, or *")
+	add((*stringValue)(&c.Database.URL), "database-url", "DATABASE_URL", "postgres connection URL")
+	add((*intValue)(&c.Database.MaxOpenConns), "db-max-open-conns", "DB_MAX_OPEN_CONNS", "maximum open database connections, 0 for no limit")
+	add((*intValue)(&c.Database.MaxIdleConns), "db-max-idle-conns", "DB_MAX_IDLE_CONNS", "maximum idle database connections")
+	add(&c.Database.ConnMaxLifetime, "db-conn-max-lifetime", "DB_CONN_MAX_LIFETIME", "maximum age of a database connection, 0 for no limit")
+	add(&c.Database.StatementTimeout, "db-statement-timeout", "DB_STATEMENT_TIMEOUT", "time allowed for each database call, 0 for no limit")
+	add((*stringValue)(&c.Auth.Mode), "auth-mode", "AUTH_MODE", "accepted credentials: apikey, jwt or both")
+	add((*stringValue)(&c.Auth.JWTKeysDir), "jwt-keys-dir", "JWT_KEYS_DIR", "directory of <kid>.secret and <kid>.pem JWT keys")
+	add((*stringValue)(&c.Auth.JWTIssuer), "jwt-issuer", "JWT_ISSUER", "required JWT issuer")
+	add((*stringValue)(&c.Auth.JWTAudience), "jwt-audience", "JWT_AUDIENCE", "required JWT audience")
+	add((*stringValue)(&c.Log.Level), "log-level", "LOG_LEVEL", "debug, info, warn or error")
+	add((*stringValue)(&c.Metrics.Token), "metrics-token", "METRICS_TOKEN", "bearer token of the /metrics scraper")
+	add((*stringValue)(&c.Tracing.Exporter), "traces-exporter", "TRACES_EXPORTER", "none, otlp, stdout or file")
+	add((*stringValue)(&c.Tracing.File), "traces-file", "TRACES_FILE", "file the file traces exporter writes to")
+	add(&c.Expenses.TrashRetention, "trash-retention", "TRASH_RETENTION", "how long deleted expenses stay in the trash")
+	add(&c.Expenses.IdempotencyTTL, "idempotency-ttl", "IDEMPOTENCY_TTL", "how long Idempotency-Key responses are kept")
+	return settings
+}
+
+// Load reads the settings for a command line. Flags override environment
+// variables, which override the config file, which overrides the defaults.
+// lookupEnv is usually os.LookupEnv.
+func Load(name string, args []string, lookupEnv func(string) (string, bool)) (*Config, Options, error) {
+	cfg := Default()
+	opts := Options{}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	settings := cfg.bind(fs)
+	fs.StringVar(&opts.File, "config", "", "YAML or TOML config file ($"+EnvFile+")")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the resulting config with secrets redacted and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, opts, err
+	}
+	opts.Args = fs.Args()
+
+	// The flags were applied first only to find the config file. Their
+	// values are set again once the file and environment are read.
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) { flags[f.Name] = f.Value.String() })
+
+	if opts.File == "" {
+		opts.File, _ = lookupEnv(EnvFile)
+	}
+	if opts.File != "" {
+		if err := cfg.loadFile(opts.File); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.env); ok {
+			if err := fs.Set(s.flag, v); err != nil {
+				return nil, opts, fmt.Errorf("$%s: %w", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flags[s.flag]; ok {
+			fs.Set(s.flag, v)
+		}
+	}
+
+	return cfg, opts, cfg.Validate()
+}
+
+// Usage writes the flags Load accepts to w.
+func Usage(w io.Writer, name string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(w)
+	Default().bind(fs)
+	fs.String("config", "", "YAML or TOML config file ($"+EnvFile+")")
+	fs.Bool("print-config", false, "print the resulting config with secrets redacted and exit")
+	fmt.Fprintf(w, "Usage of %s:\n", name)
+	fs.PrintDefaults()
+}
+
+// loadFile overlays the settings in a .yaml, .yml or .toml file. Unknown keys
+// are an error so that a typo doesn't silently leave a default in place.
+func (c *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), c)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown keys %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("%s: config file should be .yaml, .yml or .toml, not %q", path, ext)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	problems := []string{}
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port should be between 1 and 65535")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout should be positive")
+	check(c.Server.ReadyTimeout > 0, "server.ready_timeout should be positive")
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file should be set together")
+	for _, origin := range c.CORS.AllowOrigins {
+		u, err := url.Parse(origin)
+		check(origin == "*" || (err == nil && u.Scheme != "" && u.Host != "" && u.Path == ""), "cors.allow_origins should be * or scheme://host[:port]: %q", origin)
+	}
+
+	check(c.Database.URL != "", "database.url is required")
+	check(c.Database.MaxOpenConns >= 0, "database.max_open_conns should not be negative")
+	check(c.Database.MaxIdleConns >= 0, "database.max_idle_conns should not be negative")
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns, "database.max_idle_conns should not exceed database.max_open_conns")
+	check(c.Database.ConnMaxLifetime >= 0, "database.conn_max_lifetime should not be negative")
+	check(c.Database.StatementTimeout >= 0, "database.statement_timeout should not be negative")
+
+	switch c.Auth.Mode {
+	case AuthAPIKey:
+		check(c.Auth.JWTKeysDir == "", "auth.jwt_keys_dir is set but auth.mode %s ignores it, use %s or %s", AuthAPIKey, AuthJWT, AuthBoth)
+	case AuthJWT, AuthBoth:
+		check(c.Auth.JWTKeysDir != "", "auth.jwt_keys_dir is required with auth.mode %s", c.Auth.Mode)
+	default:
+		check(false, "auth.mode should be one of %s, %s, %s: %q", AuthAPIKey, AuthJWT, AuthBoth, c.Auth.Mode)
+	}
+
+	_, err := logging.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level should be one of debug, info, warn, error: %q", c.Log.Level)
+
+	switch c.Tracing.Exporter {
+	case "none", "otlp", "stdout":
+	case "file":
+		check(c.Tracing.File != "", "tracing.file is required with tracing.exporter file")
+	default:
+		check(false, "tracing.exporter should be one of none, otlp, stdout, file: %q", c.Tracing.Exporter)
+	}
+
+	check(c.Expenses.TrashRetention >= 0, "expenses.trash_retention should not be negative")
+	check(c.Expenses.IdempotencyTTL > 0, "expenses.idempotency_ttl should be positive")
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Redacted returns a copy of c that is safe to print. The database password
+// and the metrics token are replaced with logging.Redacted.
+func (c Config) Redacted() Config {
+	if c.Database.URL != "" {
+		c.Database.URL = redactURL(c.Database.URL)
+	}
+	if c.Metrics.Token != "" {
+		c.Metrics.Token = logging.Redacted
+	}
+	return c
+}
+
+// redactURL hides the password of a URL, or the whole value when it isn't a
+// URL, as with key=value connection strings.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return logging.Redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), logging.Redacted)
+	}
+	q := u.Query()
+	if q.Has("password") {
+		q.Set("password", logging.Redacted)
+		u.RawQuery = q.Encode()
+	}
+	// Keep the placeholder readable instead of percent-encoded.
+	return strings.ReplaceAll(u.String(), url.QueryEscape(logging.Redacted), logging.Redacted)
+}
+
+// Print writes c, redacted, as YAML.
+func (c Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,175 @@
+//go:build unit
+// +build unit
+
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", `
+server:
+  port: 8000
+database:
+  url: postgres://file@db/expenses
+  max_open_conns: 50
+  statement_timeout: 2s
+cors:
+  allow_origins: [https://app.example.com]
+`)
+
+	cfg, opts, err := Load("server", []string{"-config", file, "-port", "9000", "extra"}, env(map[string]string{
+		"PORT":              "8500",
+		"DB_MAX_OPEN_CONNS": "40",
+		"LOG_LEVEL":         "debug",
+	}))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, 9000, cfg.Server.Port, "flag beats env and file")
+		assert.Equal(t, 40, cfg.Database.MaxOpenConns, "env beats file")
+		assert.Equal(t, "postgres://file@db/expenses", cfg.Database.URL, "file beats default")
+		assert.Equal(t, Duration(2*time.Second), cfg.Database.StatementTimeout)
+		assert.Equal(t, []string{"https://app.example.com"}, cfg.CORS.AllowOrigins)
+		assert.Equal(t, "debug", cfg.Log.Level)
+		assert.Equal(t, 10, cfg.Database.MaxIdleConns, "default")
+		assert.Equal(t, file, opts.File)
+		assert.Equal(t, []string{"extra"}, opts.Args)
+	}
+}
+
+func TestLoadFileFromEnv(t *testing.T) {
+	file := writeFile(t, "config.toml", `
+[database]
+url = "postgres://toml@db/expenses"
+conn_max_lifetime = "1h"
+
+[auth]
+mode = "both"
+jwt_keys_dir = "/etc/keys"
+`)
+
+	cfg, _, err := Load("server", nil, env(map[string]string{EnvFile: file, "CORS_ALLOW_ORIGINS": "https://a.example.com, *"}))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "postgres://toml@db/expenses", cfg.Database.URL)
+		assert.Equal(t, Duration(time.Hour), cfg.Database.ConnMaxLifetime)
+		assert.Equal(t, AuthBoth, cfg.Auth.Mode)
+		assert.Equal(t, []string{"https://a.example.com", "*"}, cfg.CORS.AllowOrigins)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		file     string
+		expected []string
+	}{
+		{
+			name:     "TestLoadUnknownFlag",
+			args:     []string{"-nope"},
+			expected: []string{"flag provided but not defined: -nope"},
+		},
+		{
+			name:     "TestLoadBadEnv",
+			env:      map[string]string{"DATABASE_URL": "postgres://db", "DB_STATEMENT_TIMEOUT": "5"},
+			expected: []string{"$DB_STATEMENT_TIMEOUT"},
+		},
+		{
+			name:     "TestLoadUnknownFileKey",
+			env:      map[string]string{"DATABASE_URL": "postgres://db"},
+			file:     "server:\n  prot: 80\n",
+			expected: []string{"field prot not found"},
+		},
+		{
+			name: "TestLoadInvalid",
+			env: map[string]string{
+				"PORT":               "70000",
+				"DB_MAX_OPEN_CONNS":  "5",
+				"AUTH_MODE":          "jwt",
+				"TLS_CERT_FILE":      "cert.pem",
+				"CORS_ALLOW_ORIGINS": "example.com",
+				"LOG_LEVEL":          "loud",
+			},
+			expected: []string{
+				"database.url is required",
+				"database.max_idle_conns should not exceed database.max_open_conns",
+				"auth.jwt_keys_dir is required with auth.mode jwt",
+				"tls.cert_file and tls.key_file should be set together",
+				`cors.allow_origins should be * or scheme://host[:port]: "example.com"`,
+				`log.level should be one of debug, info, warn, error: "loud"`,
+				"server.port should be between 1 and 65535",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := test.args
+			if test.file != "" {
+				args = append(args, "-config", writeFile(t, "config.yml", test.file))
+			}
+			_, _, err := Load("server", args, env(test.env))
+
+			if assert.Error(t, err) {
+				for _, msg := range test.expected {
+					assert.Contains(t, err.Error(), msg)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.Database.URL = "postgres://app:s3cret@db:5432/expenses?sslmode=disable"
+	cfg.Metrics.Token = "scrape-token"
+
+	var buf bytes.Buffer
+	if assert.NoError(t, cfg.Print(&buf)) {
+		out := buf.String()
+		assert.NotContains(t, out, "s3cret")
+		assert.NotContains(t, out, "scrape-token")
+		assert.Contains(t, out, "url: postgres://app:[REDACTED]@db:5432/expenses?sslmode=disable")
+		assert.Contains(t, out, "token: '[REDACTED]'")
+		assert.Contains(t, out, "statement_timeout: 5s")
+	}
+	assert.Equal(t, "postgres://app:s3cret@db:5432/expenses?sslmode=disable", cfg.Database.URL, "the config itself is untouched")
+
+	assert.Equal(t, "[REDACTED]", redactURL("host=db user=app password=s3cret"))
+	assert.Equal(t, "postgres://db/expenses?password=[REDACTED]", redactURL("postgres://db/expenses?password=s3cret"))
+}
+
+func TestUsage(t *testing.T) {
+	var buf bytes.Buffer
+	Usage(&buf, "server")
+
+	assert.True(t, strings.HasPrefix(buf.String(), "Usage of server:"))
+	assert.Contains(t, buf.String(), "-db-max-open-conns")
+	assert.Contains(t, buf.String(), "($DATABASE_URL)")
+	assert.Contains(t, buf.String(), "-print-config")
+}
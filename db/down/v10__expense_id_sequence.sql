@@ -0,0 +1 @@
+-- The sequence only moves forward, so there is nothing to undo.
@@ -0,0 +1,10 @@
+ALTER TABLE expenses DROP COLUMN IF EXISTS search_vector;
+
+ALTER TABLE expenses ADD COLUMN search_vector TSVECTOR
+	GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', COALESCE(title, '')), 'A') ||
+		setweight(to_tsvector('english', expense_tags_text(tags)), 'A') ||
+		setweight(to_tsvector('english', COALESCE(note, '')), 'B')
+	) STORED;
+
+CREATE INDEX IF NOT EXISTS expenses_search_vector_idx ON expenses USING GIN (search_vector);
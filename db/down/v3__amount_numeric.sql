@@ -0,0 +1 @@
+ALTER TABLE expenses ALTER COLUMN amount TYPE FLOAT USING amount::float;
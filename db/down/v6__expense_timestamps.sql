@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS expenses_owner_spent_at_idx;
+ALTER TABLE expenses DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE expenses DROP COLUMN IF EXISTS created_at;
+ALTER TABLE expenses DROP COLUMN IF EXISTS spent_at;
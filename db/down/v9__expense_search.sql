@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS expenses_search_text_idx;
+DROP INDEX IF EXISTS expenses_search_vector_idx;
+ALTER TABLE expenses DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE expenses DROP COLUMN IF EXISTS search_text;
+DROP FUNCTION IF EXISTS expense_tags_text(TEXT[]);
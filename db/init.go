@@ -1,32 +1,106 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"os"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/teerit/assessment/logging"
 )
 
-func InitDB() (*sql.DB, error) {
-	connStr := os.Getenv("DATABASE_URL")
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, err
+// Open connects to the database at url without touching the schema. The
+// connection itself is made lazily, so an unreachable database is only
+// noticed on use.
+func Open(url string) (*sql.DB, error) {
+	return sql.Open("postgres", url)
+}
+
+// Backoff is the delay between attempts of Setup. It doubles from Initial up
+// to Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+var DefaultBackoff = Backoff{Initial: 500 * time.Millisecond, Max: 30 * time.Second}
+
+// Delay returns how long to wait after the given failed attempt, counted from 1.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Initial
+	for i := 1; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
 	}
+	return d
+}
 
-	createTable := `
-	CREATE TABLE IF NOT EXISTS expenses (
-		id SERIAL PRIMARY KEY,
-		title TEXT,
-		amount FLOAT,
-		note TEXT,
-		tags TEXT[]
-	);
-	`
-
-	_, err = db.Exec(createTable)
+// Setup pings db and applies any pending migrations, retrying with backoff
+// until both succeed or ctx is done. The server starts before this finishes
+// and reports itself not ready meanwhile. Errors that retrying can't fix, such
+// as a migration modified after it was applied, are returned at once.
+func Setup(ctx context.Context, db *sql.DB, backoff Backoff) error {
+	logger := logging.FromContext(ctx)
+
+	m, err := NewMigrator(db)
 	if err != nil {
-		return nil, fmt.Errorf("can't create table: %w", err)
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := setup(ctx, db, m)
+		if err == nil {
+			return nil
+		}
+		if permanent(err) {
+			return err
+		}
+
+		wait := backoff.Delay(attempt)
+		logger.Warn("database setup failed, retrying", "attempt", attempt, "retry_in", wait.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
 	}
+}
 
-	return db, nil
+// transientClasses are the classes of postgres error codes that can go away
+// by themselves: lost connections, conflicts with other transactions, a
+// server starting up or out of resources.
+var transientClasses = map[pq.ErrorClass]bool{
+	"08": true, // connection_exception
+	"40": true, // transaction_rollback
+	"53": true, // insufficient_resources
+	"55": true, // object_not_in_prerequisite_state
+	"57": true, // operator_intervention
+	"58": true, // system_error
+}
+
+// permanent reports whether err is a migration error that retrying can't fix:
+// the migrations don't match the database, or postgres rejected one of them.
+func permanent(err error) bool {
+	var modified *modifiedError
+	if errors.As(err, &modified) {
+		return true
+	}
+	var apply *applyError
+	var pqErr *pq.Error
+	return errors.As(err, &apply) && errors.As(apply.Err, &pqErr) && !transientClasses[pqErr.Code.Class()]
+}
+
+func setup(ctx context.Context, db *sql.DB, m *Migrator) error {
+	if err := db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	applied, err := m.Up(ctx)
+	for _, mig := range applied {
+		logging.FromContext(ctx).Info("applied migration", "version", mig.Version, "name", mig.Name)
+	}
+	return err
 }
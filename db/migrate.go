@@ -0,0 +1,328 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// migrationFiles holds the vN__name.sql up scripts next to this file and their
+// optional down/vN__name.sql counterparts. They are only ever applied by the
+// Migrator, which records them in schema_migrations.
+//
+//go:embed v*.sql down/*.sql
+var migrationFiles embed.FS
+
+// advisoryLockKey serializes migrations between server instances starting at
+// the same time.
+const advisoryLockKey = 2565
+
+// undefinedTable is the postgres error code for a missing relation.
+const undefinedTable = "42P01"
+
+var migrationName = regexp.MustCompile(`^v(\d+)__(\w+)\.sql$`)
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// modifiedError reports an applied migration whose file changed since.
+type modifiedError struct {
+	Migration Migration
+}
+
+func (e *modifiedError) Error() string {
+	return fmt.Sprintf("migration v%d__%s was modified after it was applied", e.Migration.Version, e.Migration.Name)
+}
+
+// applyError reports a migration script that failed.
+type applyError struct {
+	Migration Migration
+	Err       error
+}
+
+func (e *applyError) Error() string {
+	return fmt.Sprintf("can't apply migration v%d__%s: %v", e.Migration.Version, e.Migration.Name, e.Err)
+}
+
+func (e *applyError) Unwrap() error { return e.Err }
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+	// Modified is set when the applied checksum differs from the file on disk.
+	Modified bool
+}
+
+// LoadMigrations reads vN__name.sql files from the root of fsys, ordered by
+// version.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []Migration{}
+	seen := map[int]string{}
+	for _, entry := range entries {
+		m := migrationName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+
+		version, _ := strconv.Atoi(m[1])
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("duplicate migration version %d: %s and %s", version, other, entry.Name())
+		}
+		seen[version] = entry.Name()
+
+		up, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		down, err := fs.ReadFile(fsys, path.Join("down", entry.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(up)
+		migrations = append(migrations, Migration{
+			Version:  version,
+			Name:     m[2],
+			Up:       string(up),
+			Down:     string(down),
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// NewMigrator returns a Migrator for the migrations embedded in the binary.
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := LoadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Migrations: migrations}, nil
+}
+
+// Up applies every pending migration in order and returns the ones applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	applied := []Migration{}
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		status, err := m.status(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range status {
+			if s.Modified {
+				return &modifiedError{Migration: s.Migration}
+			}
+			if s.AppliedAt != nil {
+				continue
+			}
+
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, s.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)", s.Version, s.Name, s.Checksum)
+				return err
+			})
+			if err != nil {
+				return &applyError{Migration: s.Migration, Err: err}
+			}
+			applied = append(applied, s.Migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the last steps applied migrations and returns the ones reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	reverted := []Migration{}
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		status, err := m.status(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(status) - 1; i >= 0 && len(reverted) < steps; i-- {
+			s := status[i]
+			if s.AppliedAt == nil {
+				continue
+			}
+			if s.Down == "" {
+				return fmt.Errorf("migration v%d__%s has no down script", s.Version, s.Name)
+			}
+
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, s.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version=$1", s.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("can't revert migration v%d__%s: %w", s.Version, s.Name, err)
+			}
+			reverted = append(reverted, s.Migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status reports every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var status []MigrationStatus
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		var err error
+		status, err = m.status(ctx, conn)
+		return err
+	})
+	return status, err
+}
+
+// Pending returns the migrations not applied yet. Unlike Status it takes no
+// lock and creates nothing, so it is cheap enough for readiness probes and
+// doesn't wait behind a migration in progress. A modified migration is an error.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	done := map[int]string{}
+	rows, err := m.DB.QueryContext(ctx, "SELECT version, checksum FROM schema_migrations")
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr) && pqErr.Code == undefinedTable:
+		// Nothing was ever migrated.
+	case err != nil:
+		return nil, err
+	default:
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var checksum string
+			if err := rows.Scan(&version, &checksum); err != nil {
+				return nil, err
+			}
+			done[version] = checksum
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	pending := []Migration{}
+	for _, mig := range m.Migrations {
+		checksum, ok := done[mig.Version]
+		if !ok {
+			pending = append(pending, mig)
+		} else if checksum != mig.Checksum {
+			return nil, &modifiedError{Migration: mig}
+		}
+	}
+	return pending, nil
+}
+
+func (m *Migrator) status(ctx context.Context, conn *sql.Conn) ([]MigrationStatus, error) {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	`
+	if _, err := conn.ExecContext(ctx, createTable); err != nil {
+		return nil, fmt.Errorf("can't create schema_migrations table: %w", err)
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type applied struct {
+		checksum string
+		at       time.Time
+	}
+	done := map[int]applied{}
+	for rows.Next() {
+		var version int
+		var a applied
+		if err := rows.Scan(&version, &a.checksum, &a.at); err != nil {
+			return nil, err
+		}
+		done[version] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(m.Migrations))
+	for _, mig := range m.Migrations {
+		s := MigrationStatus{Migration: mig}
+		if a, ok := done[mig.Version]; ok {
+			at := a.at
+			s.AppliedAt = &at
+			s.Modified = a.checksum != mig.Checksum
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// locked runs fn on a single connection holding the migration advisory lock.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", advisoryLockKey); err != nil {
+		return fmt.Errorf("can't acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", advisoryLockKey)
+
+	return fn(conn)
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
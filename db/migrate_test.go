@@ -0,0 +1,291 @@
+//go:build unit
+// +build unit
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"v2__add_note.sql":      {Data: []byte("ALTER TABLE t ADD COLUMN note TEXT;")},
+		"v1__init.sql":          {Data: []byte("CREATE TABLE t (id INT);")},
+		"down/v1__init.sql":     {Data: []byte("DROP TABLE t;")},
+		"README.md":             {Data: []byte("not a migration")},
+		"v10__later_change.sql": {Data: []byte("SELECT 1;")},
+	}
+
+	migrations, err := LoadMigrations(fsys)
+	if assert.NoError(t, err) && assert.Len(t, migrations, 3) {
+		assert.Equal(t, 1, migrations[0].Version)
+		assert.Equal(t, "init", migrations[0].Name)
+		assert.Equal(t, "DROP TABLE t;", migrations[0].Down)
+		assert.Equal(t, 2, migrations[1].Version)
+		assert.Empty(t, migrations[1].Down)
+		assert.Equal(t, 10, migrations[2].Version)
+		assert.Len(t, migrations[0].Checksum, 64)
+	}
+}
+
+func TestLoadMigrationsDuplicateVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"v1__init.sql":  {Data: []byte("SELECT 1;")},
+		"v01__copy.sql": {Data: []byte("SELECT 1;")},
+	}
+
+	_, err := LoadMigrations(fsys)
+	assert.Error(t, err)
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(migrationFiles)
+	if assert.NoError(t, err) {
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.Version, "migration versions should have no gaps")
+			assert.NotEmpty(t, m.Down, "v%d__%s should have a down script", m.Version, m.Name)
+		}
+	}
+}
+
+// TestBaselineMigrationUnchanged pins v1, which databases set up before the
+// migration runner were created from. Schema changes go in new files.
+func TestBaselineMigrationUnchanged(t *testing.T) {
+	migrations, err := LoadMigrations(migrationFiles)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "3974c4f11e5dcc2d3219aab7cee0e75bf9ac2bed1c073d97bbf1d23ef63a6c51", migrations[0].Checksum)
+	}
+}
+
+func TestMigratorUp(t *testing.T) {
+	migrations := []Migration{
+		{Version: 1, Name: "init", Up: "CREATE TABLE t", Checksum: "aaa"},
+		{Version: 2, Name: "add_note", Up: "ALTER TABLE t", Checksum: "bbb"},
+	}
+	tests := []struct {
+		name        string
+		applied     *sqlmock.Rows
+		expectApply bool
+		expectErr   bool
+	}{
+		{
+			name:        "TestMigratorUpAppliesPending",
+			applied:     sqlmock.NewRows([]string{"version", "checksum", "applied_at"}).AddRow(1, "aaa", time.Now()),
+			expectApply: true,
+		},
+		{
+			name:      "TestMigratorUpChecksumMismatch",
+			applied:   sqlmock.NewRows([]string{"version", "checksum", "applied_at"}).AddRow(1, "changed", time.Now()),
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			mock.ExpectExec("SELECT pg_advisory_lock").WithArgs(advisoryLockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("SELECT version, checksum, applied_at FROM schema_migrations").WillReturnRows(test.applied)
+			if test.expectApply {
+				mock.ExpectBegin()
+				mock.ExpectExec("ALTER TABLE t").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(2, "add_note", "bbb").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+			mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(advisoryLockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+
+			m := &Migrator{DB: db, Migrations: migrations}
+			applied, err := m.Up(context.Background())
+
+			if test.expectErr {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) && assert.Len(t, applied, 1) {
+				assert.Equal(t, 2, applied[0].Version)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestMigratorPending(t *testing.T) {
+	migrations := []Migration{
+		{Version: 1, Name: "init", Checksum: "aaa"},
+		{Version: 2, Name: "add_note", Checksum: "bbb"},
+	}
+	tests := []struct {
+		name          string
+		applied       *sqlmock.Rows
+		queryErr      error
+		expectPending []int
+		expectErr     bool
+	}{
+		{
+			name:          "TestMigratorPendingSome",
+			applied:       sqlmock.NewRows([]string{"version", "checksum"}).AddRow(1, "aaa"),
+			expectPending: []int{2},
+		},
+		{
+			name:          "TestMigratorPendingNone",
+			applied:       sqlmock.NewRows([]string{"version", "checksum"}).AddRow(1, "aaa").AddRow(2, "bbb"),
+			expectPending: []int{},
+		},
+		{
+			name:          "TestMigratorPendingNoTable",
+			queryErr:      &pq.Error{Code: undefinedTable},
+			expectPending: []int{1, 2},
+		},
+		{
+			name:      "TestMigratorPendingModified",
+			applied:   sqlmock.NewRows([]string{"version", "checksum"}).AddRow(1, "changed"),
+			expectErr: true,
+		},
+		{
+			name:      "TestMigratorPendingQueryError",
+			queryErr:  errors.New("connection refused"),
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			query := mock.ExpectQuery("SELECT version, checksum FROM schema_migrations")
+			if test.queryErr != nil {
+				query.WillReturnError(test.queryErr)
+			} else {
+				query.WillReturnRows(test.applied)
+			}
+
+			m := &Migrator{DB: db, Migrations: migrations}
+			pending, err := m.Pending(context.Background())
+
+			if test.expectErr {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				versions := []int{}
+				for _, mig := range pending {
+					versions = append(versions, mig.Version)
+				}
+				assert.Equal(t, test.expectPending, versions)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second}
+
+	assert.Equal(t, time.Second, b.Delay(1))
+	assert.Equal(t, 2*time.Second, b.Delay(2))
+	assert.Equal(t, 4*time.Second, b.Delay(3))
+	assert.Equal(t, 5*time.Second, b.Delay(4))
+	assert.Equal(t, 5*time.Second, b.Delay(100))
+}
+
+func TestSetupRetries(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	mock.ExpectPing()
+	mock.ExpectExec("SELECT pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version", "checksum", "applied_at"})
+	migrations, _ := LoadMigrations(migrationFiles)
+	for _, m := range migrations {
+		rows.AddRow(m.Version, m.Checksum, time.Now())
+	}
+	mock.ExpectQuery("SELECT version, checksum, applied_at FROM schema_migrations").WillReturnRows(rows)
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = Setup(context.Background(), db, Backoff{Initial: time.Millisecond, Max: time.Millisecond})
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetupStopsOnPermanentError(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum string
+		applyErr error
+	}{
+		{name: "TestSetupModifiedMigration", checksum: "changed"},
+		{name: "TestSetupBrokenMigration", applyErr: &pq.Error{Code: "42601", Message: "syntax error"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			migrations, _ := LoadMigrations(migrationFiles)
+			mock.ExpectPing()
+			mock.ExpectExec("SELECT pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+			rows := sqlmock.NewRows([]string{"version", "checksum", "applied_at"})
+			if test.checksum != "" {
+				rows.AddRow(migrations[0].Version, test.checksum, time.Now())
+			}
+			mock.ExpectQuery("SELECT version, checksum, applied_at FROM schema_migrations").WillReturnRows(rows)
+			if test.applyErr != nil {
+				mock.ExpectBegin()
+				mock.ExpectExec("CREATE").WillReturnError(test.applyErr)
+				mock.ExpectRollback()
+			}
+			mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err = Setup(ctx, db, Backoff{Initial: time.Millisecond, Max: time.Millisecond})
+
+			assert.Error(t, err)
+			assert.NoError(t, ctx.Err(), "Setup kept retrying")
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPermanentMigrationError(t *testing.T) {
+	assert.False(t, permanent(&applyError{Err: &pq.Error{Code: "40P01"}}))
+	assert.False(t, permanent(&applyError{Err: errors.New("connection reset by peer")}))
+	assert.True(t, permanent(&applyError{Err: &pq.Error{Code: "42P07"}}))
+}
+
+func TestSetupCanceled(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err = Setup(ctx, db, Backoff{Initial: time.Hour, Max: time.Hour})
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
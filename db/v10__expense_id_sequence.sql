@@ -0,0 +1,3 @@
+-- v1 seeds its row with an explicit id, which leaves the id sequence behind
+-- it. Move the sequence past the largest id so new rows don't collide.
+SELECT setval(pg_get_serial_sequence('expenses', 'id'), GREATEST(max(id), 1), max(id) IS NOT NULL) FROM expenses;
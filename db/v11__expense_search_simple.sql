@@ -0,0 +1,17 @@
+-- The full-text index uses the simple configuration, which neither stems words
+-- nor drops English stop words, so Thai and English text are indexed alike.
+--
+-- Thai search also needs a database whose LC_CTYPE is a UTF-8 locale, such as
+-- en_US.UTF-8 or C.UTF-8. Under LC_CTYPE C pg_trgm only counts ASCII letters and
+-- digits as word characters, so Thai text has no trigrams: close spellings are
+-- not found and substring matches can't use expenses_search_text_idx.
+ALTER TABLE expenses DROP COLUMN IF EXISTS search_vector;
+
+ALTER TABLE expenses ADD COLUMN search_vector TSVECTOR
+	GENERATED ALWAYS AS (
+		setweight(to_tsvector('simple', COALESCE(title, '')), 'A') ||
+		setweight(to_tsvector('simple', expense_tags_text(tags)), 'A') ||
+		setweight(to_tsvector('simple', COALESCE(note, '')), 'B')
+	) STORED;
+
+CREATE INDEX IF NOT EXISTS expenses_search_vector_idx ON expenses USING GIN (search_vector);
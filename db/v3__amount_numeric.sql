@@ -0,0 +1 @@
+ALTER TABLE expenses ALTER COLUMN amount TYPE NUMERIC(14,2) USING round(amount::numeric, 2);
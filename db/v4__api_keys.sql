@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	key_hash TEXT NOT NULL UNIQUE,
+	subject TEXT NOT NULL,
+	roles TEXT[] NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	revoked_at TIMESTAMPTZ
+);
@@ -0,0 +1,4 @@
+-- Rows created before ownership existed get an empty owner and are only
+-- visible to admins.
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS owner_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS expenses_owner_id_idx ON expenses (owner_id, id);
@@ -0,0 +1 @@
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	owner_id TEXT NOT NULL,
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	status INT NOT NULL DEFAULT 0,
+	body BYTEA,
+	expires_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (owner_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
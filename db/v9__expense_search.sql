@@ -0,0 +1,23 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- array_to_string is only stable in general but immutable for text[], which
+-- generated columns require.
+CREATE OR REPLACE FUNCTION expense_tags_text(tags TEXT[]) RETURNS TEXT
+	LANGUAGE sql IMMUTABLE PARALLEL SAFE
+	AS $$ SELECT COALESCE(array_to_string(tags, ' '), '') $$;
+
+-- search_text backs substring and typo tolerant matching with trigrams. It also
+-- finds words inside Thai text, which is written without spaces and therefore
+-- only splits into lexemes at punctuation and whitespace.
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS search_text TEXT
+	GENERATED ALWAYS AS (lower(COALESCE(title, '') || ' ' || COALESCE(note, '') || ' ' || expense_tags_text(tags))) STORED;
+
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS search_vector TSVECTOR
+	GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', COALESCE(title, '')), 'A') ||
+		setweight(to_tsvector('english', expense_tags_text(tags)), 'A') ||
+		setweight(to_tsvector('english', COALESCE(note, '')), 'B')
+	) STORED;
+
+CREATE INDEX IF NOT EXISTS expenses_search_vector_idx ON expenses USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS expenses_search_text_idx ON expenses USING GIN (search_text gin_trgm_ops);
@@ -0,0 +1,197 @@
+package expense
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/apierror"
+	"github.com/teerit/assessment/logging"
+)
+
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+
+	BatchAtomic  = "atomic"
+	BatchPartial = "partial"
+)
+
+// MaxBatchSize is the largest number of operations accepted in one batch.
+const MaxBatchSize = 1000
+
+// ErrBatchAborted is reported for the operations of an atomic batch that were
+// rolled back because another operation failed.
+var ErrBatchAborted = errors.New("not applied because another operation in the batch failed")
+
+// BatchOp is one operation of a batch. Expense carries the fields of a create
+// or update, and Version the If-Match of an update.
+type BatchOp struct {
+	Op      string   `json:"op"`
+	Id      int      `json:"id,omitempty"`
+	Version int      `json:"version,omitempty"`
+	Expense *Expense `json:"expense,omitempty"`
+}
+
+type BatchRequest struct {
+	// Mode is BatchAtomic, the default, or BatchPartial.
+	Mode       string    `json:"mode"`
+	Operations []BatchOp `json:"operations"`
+}
+
+type BatchResult struct {
+	Op      string        `json:"op"`
+	Status  int           `json:"status"`
+	Code    apierror.Code `json:"code,omitempty"`
+	Id      int           `json:"id,omitempty"`
+	Expense *Expense      `json:"expense,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Errors  []FieldError  `json:"errors,omitempty"`
+}
+
+type BatchResponse struct {
+	Mode      string        `json:"mode"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// abortBatch marks every operation that didn't fail itself as rolled back.
+func abortBatch(errs []error) []error {
+	for i, err := range errs {
+		if err == nil {
+			errs[i] = ErrBatchAborted
+		}
+	}
+	return errs
+}
+
+// BatchExpensesHandler serves POST /expenses:batch. It responds 200 when every
+// operation succeeded, 207 when some failed in partial mode and 422 when an
+// atomic batch was rolled back.
+func (h *handler) BatchExpensesHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	req := BatchRequest{}
+	if err := c.Bind(&req); err != nil {
+		return bindErr(err)
+	}
+	if req.Mode == "" {
+		req.Mode = BatchAtomic
+	}
+	if req.Mode != BatchAtomic && req.Mode != BatchPartial {
+		return apierror.BadRequest("mode should be atomic or partial")
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > MaxBatchSize {
+		return apierror.BadRequest(fmt.Sprintf("operations should have between 1 and %d items", MaxBatchSize))
+	}
+	atomic := req.Mode == BatchAtomic
+
+	// Operations that can't be run are answered here; the rest go to the store.
+	res := BatchResponse{Mode: req.Mode, Results: make([]BatchResult, len(req.Operations))}
+	ops, at := []BatchOp{}, []int{}
+	for i, op := range req.Operations {
+		res.Results[i] = BatchResult{Op: op.Op, Id: op.Id}
+		r := &res.Results[i]
+		if msg := checkBatchOp(op); msg != "" {
+			r.Status, r.Code, r.Error = http.StatusBadRequest, apierror.CodeBadRequest, msg
+			continue
+		}
+		if op.Expense != nil {
+			if verr := op.Expense.Validate(); verr != nil {
+				r.Status, r.Code, r.Error, r.Errors = http.StatusUnprocessableEntity, apierror.CodeValidationFailed, verr.Message, verr.Errors
+				continue
+			}
+		}
+		switch op.Op {
+		case BatchCreate:
+			op.Expense.Id, op.Expense.OwnerId = 0, scope.Owner
+			op.Expense.CreatedAt, op.Expense.UpdatedAt, op.Expense.DeletedAt = time.Time{}, time.Time{}, nil
+		case BatchUpdate:
+			op.Expense.Id, op.Expense.Version = op.Id, op.Version
+		}
+		ops, at = append(ops, op), append(at, i)
+	}
+
+	ctx := c.Request().Context()
+	var errs []error
+	if atomic && len(ops) < len(req.Operations) {
+		errs = abortBatch(make([]error, len(ops)))
+	} else {
+		var err error
+		if errs, err = h.Store.Batch(ctx, scope, ops, atomic); err != nil {
+			return storeErr(ctx, err)
+		}
+	}
+
+	for j, op := range ops {
+		r := &res.Results[at[j]]
+		switch err := errs[j]; {
+		case err == nil:
+			r.Status, r.Expense = batchStatus[op.Op], op.Expense
+			if op.Expense != nil {
+				r.Id = op.Expense.Id
+			}
+			if op.Op == BatchCreate {
+				recordCreated(op.Expense)
+			}
+		case err == ErrBatchAborted:
+			r.Status, r.Code, r.Error = http.StatusFailedDependency, apierror.CodeBatchAborted, err.Error()
+		default:
+			aerr := apierror.From(storeErr(ctx, err))
+			if aerr.Err != nil {
+				logging.FromContext(ctx).Error("batch op failed", "index", at[j], "op", op.Op, "error", aerr)
+			}
+			r.Status, r.Code, r.Error = aerr.Status, aerr.Code, aerr.Detail
+		}
+	}
+
+	for _, r := range res.Results {
+		if r.Error == "" {
+			res.Succeeded++
+		} else {
+			res.Failed++
+		}
+	}
+
+	status := http.StatusOK
+	switch {
+	case res.Failed > 0 && atomic:
+		status = http.StatusUnprocessableEntity
+	case res.Failed > 0:
+		status = http.StatusMultiStatus
+	}
+	return c.JSON(status, res)
+}
+
+var batchStatus = map[string]int{
+	BatchCreate: http.StatusCreated,
+	BatchUpdate: http.StatusOK,
+	BatchDelete: http.StatusNoContent,
+}
+
+func checkBatchOp(op BatchOp) string {
+	switch op.Op {
+	case BatchCreate:
+		if op.Expense == nil {
+			return "create needs an expense"
+		}
+	case BatchUpdate:
+		if op.Id < 1 || op.Expense == nil {
+			return "update needs an id and an expense"
+		}
+	case BatchDelete:
+		if op.Id < 1 {
+			return "delete needs an id"
+		}
+	default:
+		return fmt.Sprintf("op should be create, update or delete: %q", op.Op)
+	}
+	return ""
+}
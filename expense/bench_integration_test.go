@@ -0,0 +1,94 @@
+//go:build integration
+// +build integration
+
+package expense
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/teerit/assessment/db"
+)
+
+// benchDatabaseURL is the database of the integration tests unless
+// DATABASE_URL names another one.
+const benchDatabaseURL = "postgresql://root:root@db/assessment-db?sslmode=disable"
+
+// Compare with
+//
+//	DATABASE_URL=... go test -tags=integration -run '^$' -bench . -benchtime 5s ./expense/
+func BenchmarkPostgresGet(b *testing.B) {
+	benchmarkStore(b, func(s *postgresStore, scope Scope, id int) error {
+		_, err := s.Get(context.Background(), scope, id)
+		return err
+	})
+}
+
+func BenchmarkPostgresList(b *testing.B) {
+	benchmarkStore(b, func(s *postgresStore, scope Scope, id int) error {
+		_, err := s.List(context.Background(), ListQuery{Scope: scope, Sort: "id", Paginate: true, Limit: DefaultPageLimit})
+		return err
+	})
+}
+
+// benchmarkStore runs fn in parallel with and without the statement cache,
+// for a few pool sizes.
+func benchmarkStore(b *testing.B, fn func(s *postgresStore, scope Scope, id int) error) {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		url = benchDatabaseURL
+	}
+	conn, err := sql.Open("postgres", url)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := db.Setup(ctx, conn, db.DefaultBackoff); err != nil {
+		b.Fatal(err)
+	}
+
+	scope := Scope{Owner: "bench-user"}
+	exp := &Expense{Title: "strawberry smoothie", Amount: 79 * Baht, Tags: []string{"food"}, OwnerId: scope.Owner}
+	if err := NewPostgresStore(conn).Create(context.Background(), exp); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, conns := range []int{4, 16} {
+		for _, prepared := range []bool{false, true} {
+			name := fmt.Sprintf("conns=%d/unprepared", conns)
+			if prepared {
+				name = fmt.Sprintf("conns=%d/prepared", conns)
+			}
+			b.Run(name, func(b *testing.B) {
+				conn.SetMaxOpenConns(conns)
+				conn.SetMaxIdleConns(conns)
+
+				s := &postgresStore{DB: conn, Timeout: DefaultStatementTimeout}
+				if prepared {
+					s = NewPostgresStore(conn)
+					if err := s.Prepare(context.Background()); err != nil {
+						b.Fatal(err)
+					}
+					defer s.Close()
+				}
+
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if err := fn(s, scope, exp.Id); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -1,24 +1,103 @@
 package expense
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
-	"github.com/lib/pq"
+	"github.com/teerit/assessment/apierror"
+	"github.com/teerit/assessment/metrics"
 )
 
 func (h *handler) CreateExpenseHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	ctx := c.Request().Context()
+	key := c.Request().Header.Get("Idempotency-Key")
+	if key == "" || h.Keys == nil {
+		exp, err := h.createExpense(c, scope)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusCreated, exp)
+	}
+	if len(key) > MaxIdempotencyKeyLength {
+		return apierror.BadRequest("Idempotency-Key is too long")
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return apierror.BadRequest("can't read request body").Wrap(err)
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+	hash := requestHash(body)
+	stored, err := h.Keys.Reserve(ctx, scope.Owner, key, hash, IdempotencyLease)
+	if err != nil {
+		return storeErr(ctx, err)
+	}
+	if stored != nil {
+		switch {
+		case stored.Hash != hash:
+			return apierror.New(http.StatusUnprocessableEntity, apierror.CodeIdempotencyKeyReused, "Idempotency-Key was already used with a different request")
+		case stored.Status == 0:
+			return apierror.New(http.StatusConflict, apierror.CodeConflict, "a request with this Idempotency-Key is still in progress")
+		}
+		c.Response().Header().Set("Idempotent-Replayed", "true")
+		return c.JSONBlob(stored.Status, stored.Body)
+	}
+
+	// Only a created expense is kept for replay. On any other outcome the key
+	// is freed so the client can fix the request and retry.
+	exp, err := h.createExpense(c, scope)
+	var b []byte
+	if err == nil {
+		b, _ = json.Marshal(exp)
+		if cerr := h.Keys.Complete(ctx, scope.Owner, key, http.StatusCreated, b, h.KeyTTL); cerr != nil {
+			err = storeErr(ctx, cerr)
+		}
+	}
+	if err != nil {
+		// The request context may be what failed, and a key left reserved
+		// would block retries until it expires.
+		h.Keys.Release(context.Background(), scope.Owner, key)
+		return err
+	}
+	return c.JSONBlob(http.StatusCreated, b)
+}
+
+// createExpense creates the expense in the request body.
+func (h *handler) createExpense(c echo.Context, scope Scope) (Expense, error) {
 	exp := Expense{}
 	err := c.Bind(&exp)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+		return exp, bindErr(err)
 	}
-	ins := "INSERT INTO expenses (title, amount, note, tags) values ($1, $2, $3, $4) RETURNING id"
-	row := h.DB.QueryRow(ins, exp.Title, exp.Amount, exp.Note, pq.Array(exp.Tags))
-	err = row.Scan(&exp.Id)
+	if verr := exp.Validate(); verr != nil {
+		return exp, invalid(verr)
+	}
+
+	exp.OwnerId = scope.Owner
+	exp.CreatedAt, exp.UpdatedAt, exp.DeletedAt = time.Time{}, time.Time{}, nil
+	err = h.Store.Create(c.Request().Context(), &exp)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		return exp, storeErr(c.Request().Context(), err)
 	}
+	recordCreated(&exp)
 
-	return c.JSON(http.StatusCreated, exp)
+	return exp, nil
+}
+
+// recordCreated counts newly stored expenses in the business metrics.
+func recordCreated(exps ...*Expense) {
+	for _, exp := range exps {
+		metrics.ExpenseCreated(exp.Amount.Float(), exp.Tags)
+	}
 }
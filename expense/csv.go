@@ -0,0 +1,347 @@
+package expense
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/apierror"
+)
+
+const (
+	// TagSeparator joins the tags of an expense into one CSV field.
+	TagSeparator = ";"
+	// exportBatch is how many rows the export reads from the store at a time.
+	exportBatch = 500
+	// MaxImportBytes bounds the request body of an import.
+	MaxImportBytes = 10 << 20
+	// MaxImportRows bounds the rows of an import, which are all held in
+	// memory and inserted in one transaction.
+	MaxImportRows = 10000
+)
+
+var errTooManyRows = fmt.Errorf("csv should have at most %d rows", MaxImportRows)
+
+// formulaPrefixes start a cell that spreadsheets evaluate as a formula.
+const formulaPrefixes = "=+-@\t\r"
+
+// csvText stops a spreadsheet from evaluating exported text as a formula by
+// prefixing it with a quote. importText strips the quote again.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune(formulaPrefixes, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// importText undoes csvText so that exported files import unchanged.
+func importText(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(formulaPrefixes, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+var csvHeader = []string{"id", "title", "amount", "note", "tags", "spent_at", "created_at", "updated_at"}
+
+// importFields are the expense fields an import can set. title and amount are
+// required.
+var importFields = []string{"title", "amount", "note", "tags", "spent_at"}
+
+// ExportCSVHandler streams the expenses matching the list filters as CSV. It
+// walks the store page by page so memory use doesn't grow with the table.
+func (h *handler) ExportCSVHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	q, err := ParseListQuery(c)
+	if err != nil {
+		return queryErr(err)
+	}
+	q.Scope, q.Paginate, q.Limit, q.Cursor = scope, true, exportBatch, nil
+
+	ctx := c.Request().Context()
+	exps, err := h.Store.List(ctx, q)
+	if err != nil {
+		return storeErr(ctx, err)
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="expenses.csv"`)
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	w.Write(csvHeader)
+	for {
+		more := len(exps) > q.Limit
+		if more {
+			exps = exps[:q.Limit]
+		}
+		for _, exp := range exps {
+			w.Write([]string{
+				strconv.Itoa(exp.Id),
+				csvText(exp.Title),
+				exp.Amount.String(),
+				csvText(exp.Note),
+				csvText(strings.Join(exp.Tags, TagSeparator)),
+				exp.SpentAt.Format(time.RFC3339),
+				exp.CreatedAt.Format(time.RFC3339),
+				exp.UpdatedAt.Format(time.RFC3339),
+			})
+		}
+		w.Flush()
+		res.Flush()
+		if err := w.Error(); err != nil || !more {
+			return err
+		}
+
+		cur := q.NextCursor(exps[len(exps)-1])
+		q.Cursor = &cur
+		// The status line is already sent, so a failure can only cut the
+		// stream short.
+		if exps, err = h.Store.List(ctx, q); err != nil {
+			return err
+		}
+	}
+}
+
+type LineError struct {
+	Line    int    `json:"line"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportResult struct {
+	DryRun   bool        `json:"dry_run"`
+	Rows     int         `json:"rows"`
+	Imported int         `json:"imported"`
+	Errors   []LineError `json:"errors"`
+}
+
+// ImportCSVHandler creates expenses from a CSV body, or from the "file" field
+// of a multipart form. Columns are matched to fields by header name unless
+// remapped with map=field:Header,... Every row is validated first; any error
+// rejects the whole file with a 422 listing the errors per line. With
+// dry_run=true nothing is written. Bodies over MaxImportBytes and files over
+// MaxImportRows are rejected with a 413.
+func (h *handler) ImportCSVHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	mapping, err := parseHeaderMapping(c.QueryParam("map"))
+	if err != nil {
+		return apierror.BadRequest(err.Error())
+	}
+	dryRun, _ := strconv.ParseBool(c.QueryParam("dry_run"))
+
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, MaxImportBytes)
+	body := io.Reader(req.Body)
+	// Any other body is the CSV itself. Parsing it as a form, as FormFile
+	// does for application/x-www-form-urlencoded, would consume it.
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType)); mediaType == echo.MIMEMultipartForm {
+		file, err := c.FormFile("file")
+		if err != nil {
+			return importErr(err, `multipart import should have a "file" field`)
+		}
+		f, err := file.Open()
+		if err != nil {
+			return apierror.BadRequest("can't open uploaded file").Wrap(err)
+		}
+		defer f.Close()
+		body = f
+	}
+
+	exps, lineErrs, err := readCSV(body, mapping)
+	if err != nil {
+		return importErr(err, err.Error())
+	}
+
+	result := ImportResult{DryRun: dryRun, Rows: len(exps) + countLines(lineErrs), Errors: lineErrs}
+	if len(lineErrs) > 0 {
+		return apierror.Newf(http.StatusUnprocessableEntity, apierror.CodeValidationFailed, "%d of %d rows are invalid", countLines(lineErrs), result.Rows).WithErrors(lineErrs)
+	}
+	if dryRun {
+		return c.JSON(http.StatusOK, result)
+	}
+
+	for _, exp := range exps {
+		exp.OwnerId = scope.Owner
+	}
+	if err := h.Store.CreateBatch(c.Request().Context(), exps); err != nil {
+		return storeErr(c.Request().Context(), err)
+	}
+	recordCreated(exps...)
+	result.Imported = len(exps)
+
+	return c.JSON(http.StatusCreated, result)
+}
+
+// importErr reports a body over the size or row limit with a 413 and any
+// other unusable file with a 400 and detail.
+func importErr(err error, detail string) error {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return apierror.Newf(http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, "import should be at most %d bytes", MaxImportBytes)
+	case errors.Is(err, errTooManyRows):
+		return apierror.New(http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, err.Error())
+	}
+	return apierror.BadRequest(detail).Wrap(err)
+}
+
+// parseHeaderMapping reads "field:Header,field:Header" into field -> header.
+func parseHeaderMapping(s string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, f := range importFields {
+		mapping[f] = f
+	}
+	if s == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		field, header, ok := strings.Cut(pair, ":")
+		if _, known := mapping[field]; !ok || !known || header == "" {
+			return nil, fmt.Errorf("map should be field:Header pairs with fields %s: %q", strings.Join(importFields, ", "), pair)
+		}
+		mapping[field] = header
+	}
+	return mapping, nil
+}
+
+// readCSV parses and validates every row. It only returns an error when the
+// file as a whole is unusable: its header is missing, it can't be read or it
+// has more than MaxImportRows rows.
+func readCSV(body io.Reader, mapping map[string]string) ([]*Expense, []LineError, error) {
+	r := csv.NewReader(body)
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("csv is empty")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	col := map[string]int{}
+	for field, name := range mapping {
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				col[field] = i
+			}
+		}
+	}
+	for _, field := range []string{"title", "amount"} {
+		if _, ok := col[field]; !ok {
+			return nil, nil, fmt.Errorf("csv header has no %q column for %s", mapping[field], field)
+		}
+	}
+
+	exps := []*Expense{}
+	lineErrs := []LineError{}
+	for rows := 0; ; rows++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if rows == MaxImportRows {
+			return nil, nil, errTooManyRows
+		}
+		// A malformed record is reported for its line like any other
+		// invalid row, and reading goes on with the next one.
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			lineErrs = append(lineErrs, LineError{Line: perr.StartLine, Message: perr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line, _ := r.FieldPos(0)
+		exp, errs := parseRecord(record, col, line)
+		if len(errs) > 0 {
+			lineErrs = append(lineErrs, errs...)
+			continue
+		}
+		exps = append(exps, exp)
+	}
+	return exps, lineErrs, nil
+}
+
+func parseRecord(record []string, col map[string]int, line int) (*Expense, []LineError) {
+	get := func(field string) string {
+		if i, ok := col[field]; ok && i < len(record) {
+			return importText(strings.TrimSpace(record[i]))
+		}
+		return ""
+	}
+
+	exp := &Expense{Title: get("title"), Note: get("note"), Tags: []string{}}
+	fieldErrs := map[string]string{}
+
+	amount, err := ParseMoney(get("amount"))
+	if err != nil {
+		fieldErrs["amount"] = err.Error()
+	}
+	exp.Amount = amount
+
+	if tags := get("tags"); tags != "" {
+		for _, tag := range strings.Split(tags, TagSeparator) {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				exp.Tags = append(exp.Tags, tag)
+			}
+		}
+	}
+
+	if s := get("spent_at"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", s); err != nil {
+				fieldErrs["spent_at"] = "spent_at should be RFC 3339 time or date"
+			}
+		}
+		exp.SpentAt = t
+	}
+
+	// A value that didn't parse is reported instead of the rules it breaks.
+	if verr := exp.Validate(); verr != nil {
+		for _, fe := range verr.Errors {
+			if _, ok := fieldErrs[fe.Field]; !ok {
+				fieldErrs[fe.Field] = fe.Message
+			}
+		}
+	}
+
+	errs := []LineError{}
+	for _, field := range importFields {
+		if msg, ok := fieldErrs[field]; ok {
+			errs = append(errs, LineError{Line: line, Field: field, Message: msg})
+		}
+	}
+	return exp, errs
+}
+
+// countLines counts the distinct lines with errors.
+func countLines(errs []LineError) int {
+	lines := map[int]bool{}
+	for _, e := range errs {
+		lines[e.Line] = true
+	}
+	return len(lines)
+}
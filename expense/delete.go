@@ -0,0 +1,27 @@
+package expense
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/apierror"
+)
+
+func (h *handler) DeleteExpenseHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	rowId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apierror.BadRequest("id should be int")
+	}
+
+	if err := h.Store.Delete(c.Request().Context(), scope, rowId); err != nil {
+		return storeErr(c.Request().Context(), err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
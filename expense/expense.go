@@ -1,23 +1,132 @@
 package expense
 
-import "database/sql"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/apierror"
+	"github.com/teerit/assessment/auth"
+)
+
+// DefaultTrashRetention is how long a soft-deleted expense stays in the trash
+// before it can be purged.
+const DefaultTrashRetention = 30 * 24 * time.Hour
 
 type Expense struct {
-	Id     int      `json:"id"`
-	Title  string   `json:"title"`
-	Amount float64  `json:"amount"`
-	Note   string   `json:"note"`
-	Tags   []string `json:"tags"`
+	Id        int        `json:"id"`
+	Title     string     `json:"title"`
+	Amount    Money      `json:"amount"`
+	Note      string     `json:"note"`
+	Tags      []string   `json:"tags"`
+	OwnerId   string     `json:"owner_id,omitempty"`
+	SpentAt   time.Time  `json:"spent_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Version counts updates and is sent as the ETag rather than in the body.
+	Version int `json:"-"`
 }
 
 type handler struct {
-	DB *sql.DB
+	Store     ExpenseStore
+	Retention time.Duration
+	// Keys stores the responses of creates sent with an Idempotency-Key for
+	// KeyTTL. Without it the header is ignored.
+	Keys   IdempotencyStore
+	KeyTTL time.Duration
+}
+
+func ExpenseHandler(store ExpenseStore) *handler {
+	return &handler{
+		Store:     store,
+		Retention: DefaultTrashRetention,
+		Keys:      NewMemoryIdempotencyStore(),
+		KeyTTL:    DefaultIdempotencyTTL,
+	}
+}
+
+// bindErr turns a c.Bind failure into a 400. Amount errors are reported as is
+// instead of echo's "code=400, message=..." wrapper.
+func bindErr(err error) error {
+	var merr *MoneyError
+	if errors.As(err, &merr) {
+		return apierror.BadRequest(merr.Error()).Wrap(err)
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) && he.Code < http.StatusInternalServerError {
+		return apierror.BadRequest(fmt.Sprint(he.Message)).Wrap(he.Internal)
+	}
+	return apierror.BadRequest("invalid request body").Wrap(err)
+}
+
+// storeErr turns an ExpenseStore error into the response for it. ctx is the
+// request's context: once it is done the client has gone away, and any error
+// is put down to that rather than to the database.
+func storeErr(ctx context.Context, err error) error {
+	switch {
+	case err == ErrNotFound:
+		return apierror.New(http.StatusNotFound, apierror.CodeExpenseNotFound, "expense not found with given id")
+	case err == ErrVersionMismatch:
+		return apierror.New(http.StatusPreconditionFailed, apierror.CodePreconditionFailed, "expense was modified since it was fetched, get it again and retry")
+	case ctx.Err() != nil || errors.Is(err, context.Canceled):
+		return apierror.New(apierror.StatusClientClosedRequest, apierror.CodeClientClosedRequest, "request was canceled by the client").Wrap(err)
+	case isTimeout(err):
+		return apierror.New(http.StatusServiceUnavailable, apierror.CodeDatabaseTimeout, "the database did not respond in time, retry later").Wrap(err)
+	}
+	return apierror.Internal(err)
+}
+
+// queryErr turns an error in the query parameters into a 400 response. A
+// filter error also reports the column it was found at.
+func queryErr(err error) error {
+	var ferr *FilterError
+	if errors.As(err, &ferr) {
+		return apierror.New(http.StatusBadRequest, apierror.CodeInvalidFilter, ferr.Error()).WithErrors([]*FilterError{ferr})
+	}
+	return apierror.BadRequest(err.Error())
+}
+
+// scopeOf returns the expenses the authenticated caller may touch: their own,
+// or for admins every owner's unless narrowed with ?owner=.
+func scopeOf(c echo.Context) (Scope, bool) {
+	p, ok := auth.FromContext(c)
+	if !ok {
+		return Scope{}, false
+	}
+	if p.HasRole(auth.RoleAdmin) {
+		if owner := c.QueryParam("owner"); owner != "" {
+			return Scope{Owner: owner}, true
+		}
+		return Scope{Owner: p.Subject, All: true}, true
+	}
+	return Scope{Owner: p.Subject}, true
+}
+
+// ETag is the strong entity tag of the expense's current version.
+func (exp Expense) ETag() string {
+	return `"` + strconv.Itoa(exp.Version) + `"`
 }
 
-func ExpenseHandler(db *sql.DB) *handler {
-	return &handler{db}
+// parseIfMatch returns the version an If-Match header requires, or 0 when the
+// header is absent or "*". A tag that isn't one of ours can never match.
+func parseIfMatch(header string) int {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0
+	}
+	v, err := strconv.Atoi(strings.Trim(header, `"`))
+	if err != nil || !strings.HasPrefix(header, `"`) || v < 1 {
+		return -1
+	}
+	return v
 }
 
-type Err struct {
-	Message string `json:"message"`
+func unauthorized() error {
+	return apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "authentication required")
 }
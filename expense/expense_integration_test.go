@@ -9,32 +9,61 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/teerit/assessment/apierror"
+	"github.com/teerit/assessment/auth"
+	"github.com/teerit/assessment/db"
 	"github.com/teerit/assessment/util"
 )
 
 func TestITExpenses(t *testing.T) {
 	eh := echo.New()
 	go func(e *echo.Echo) {
-		db, err := sql.Open("postgres", "postgresql://root:root@db/assessment-db?sslmode=disable")
+		conn, err := sql.Open("postgres", "postgresql://root:root@db/assessment-db?sslmode=disable")
 		if err != nil {
 			log.Fatal(err)
 		}
+		// The schema comes from the migration runner, as it does for the server.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := db.Setup(ctx, conn, db.DefaultBackoff); err != nil {
+			log.Fatal(err)
+		}
 
-		h := ExpenseHandler(db)
+		h := ExpenseHandler(NewPostgresStore(conn))
+		e.HTTPErrorHandler = apierror.HTTPErrorHandler
+		h.Keys = NewPostgresIdempotencyStore(conn)
+
+		e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set(auth.ContextKey, &auth.Principal{Subject: "it-user"})
+				return next(c)
+			}
+		})
 
 		e.POST("/expenses", h.CreateExpenseHandler)
 		e.GET("/expenses/:id", h.GetExpenseByIdHandler)
 		e.GET("/expenses", h.GetExpensesHandler)
 		e.PUT("/expenses/:id", h.UpdateExpenseHandler)
+		e.PATCH("/expenses/:id", h.PatchExpenseHandler)
+		e.DELETE("/expenses/:id", h.DeleteExpenseHandler)
+		e.GET("/expenses/summary", h.GetSummaryHandler)
+		e.GET("/expenses/search", h.SearchExpensesHandler)
+		e.GET("/expenses/export.csv", h.ExportCSVHandler)
+		e.POST("/expenses/import", h.ImportCSVHandler)
+		e.POST("/expenses\\:batch", h.BatchExpensesHandler)
+		e.GET("/expenses/trash", h.GetTrashHandler)
+		e.POST("/expenses/:id/restore", h.RestoreExpenseHandler)
 
 		e.Start(fmt.Sprintf(":%d", util.ServerPort))
 	}(eh)
@@ -61,6 +90,90 @@ func TestITExpenses(t *testing.T) {
 		assert.Greater(t, len(exps), 0)
 	})
 
+	t.Run("TestGetExpensesPage", func(t *testing.T) {
+		seedExpense(t)
+		seedExpense(t)
+		var page ExpensePage
+
+		res := util.Request(http.MethodGet, util.Uri("expenses?limit=1&tag=food&sort=-id"), nil)
+		err := res.Decode(&page)
+
+		assert.Nil(t, err)
+		assert.EqualValues(t, http.StatusOK, res.StatusCode)
+		assert.Len(t, page.Data, 1)
+		assert.NotEmpty(t, page.NextCursor)
+		assert.Greater(t, page.Total, 1)
+	})
+
+	t.Run("TestGetSummaryByTag", func(t *testing.T) {
+		seedExpense(t)
+		var summary Summary
+
+		res := util.Request(http.MethodGet, util.Uri("expenses", "summary?group_by=tag,month&tz=Asia/Bangkok"), nil)
+		err := res.Decode(&summary)
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, []string{"tag", "month"}, summary.GroupBy)
+		assert.NotEmpty(t, summary.Groups)
+	})
+
+	t.Run("TestSearchExpenses", func(t *testing.T) {
+		seedExpense(t)
+		var results SearchResults
+
+		res := util.Request(http.MethodGet, util.Uri("expenses", "search?q=smoothy"), nil)
+		err := res.Decode(&results)
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		if assert.NotEmpty(t, results.Data) {
+			assert.Contains(t, results.Data[0].Snippet, "<mark>smoothie</mark>")
+		}
+	})
+
+	t.Run("TestSearchThaiExpenses", func(t *testing.T) {
+		var created Expense
+		body := bytes.NewBufferString(`{"title": "ข้าวมันไก่ประตูน้ำ", "amount": 50, "note": "ร้านเจ้าเก่า", "tags": ["food"]}`)
+		err := util.Request(http.MethodPost, util.Uri("expenses"), body).Decode(&created)
+		if err != nil {
+			t.Fatal("can't create expense:", err)
+		}
+
+		// A word inside the title, and the title with a wrong vowel, which only
+		// matches when pg_trgm sees Thai letters.
+		for _, q := range []string{"มันไก่", "ข้าวมันไก่ประตุน้ำ"} {
+			var results SearchResults
+			res := util.Request(http.MethodGet, util.Uri("expenses", "search?q="+url.QueryEscape(q)), nil)
+			err := res.Decode(&results)
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			ids := []int{}
+			for _, r := range results.Data {
+				ids = append(ids, r.Id)
+			}
+			assert.Contains(t, ids, created.Id, "q=%s", q)
+		}
+	})
+
+	t.Run("TestImportAndExportCSV", func(t *testing.T) {
+		var result ImportResult
+		body := bytes.NewBufferString("title,amount,tags\ncsv import test,12.50,import\n")
+		res := util.Request(http.MethodPost, util.Uri("expenses", "import"), body)
+		err := res.Decode(&result)
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Equal(t, 1, result.Imported)
+
+		res = util.Request(http.MethodGet, util.Uri("expenses", "export.csv?tag=import"), nil)
+		assert.Nil(t, res.Err)
+		csv, _ := io.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Contains(t, string(csv), "csv import test,12.50,import,")
+	})
+
 	t.Run("TestGetExpenseById", func(t *testing.T) {
 		c := seedExpense(t)
 
@@ -97,7 +210,7 @@ func TestITExpenses(t *testing.T) {
 		c := Expense{
 			Id:     id,
 			Title:  "strawberry smoothie",
-			Amount: 79,
+			Amount: 79 * Baht,
 			Note:   "night market promotion discount 10 bath",
 			Tags:   []string{"food", "beverage"},
 		}
@@ -129,7 +242,7 @@ func TestITExpenses(t *testing.T) {
 		assert.Equal(t, http.StatusCreated, res.StatusCode)
 		assert.NotEqual(t, 0, exp.Id)
 		assert.Equal(t, "strawberry smoothie", exp.Title)
-		assert.Equal(t, 79.0, exp.Amount)
+		assert.Equal(t, 79*Baht, exp.Amount)
 		assert.Equal(t, "night market promotion discount 10 bath", exp.Note)
 
 		t.Run("TestCreateExpenseBadRequest", func(t *testing.T) {
@@ -149,6 +262,79 @@ func TestITExpenses(t *testing.T) {
 		})
 	})
 
+	t.Run("TestCreateExpenseIdempotencyKey", func(t *testing.T) {
+		key := "it-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		create := func(body string) (*util.Response, Expense) {
+			req, _ := http.NewRequest(http.MethodPost, util.Uri("expenses"), bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", key)
+			res, err := http.DefaultClient.Do(req)
+			r := &util.Response{Response: res, Err: err}
+			var exp Expense
+			r.Decode(&exp)
+			return r, exp
+		}
+
+		res, first := create(`{"title": "idempotent", "amount": 10}`)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+		res, replay := create(`{"title": "idempotent", "amount": 10}`)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Equal(t, first.Id, replay.Id)
+
+		res, _ = create(`{"title": "idempotent", "amount": 20}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	})
+
+	t.Run("TestBatchExpenses", func(t *testing.T) {
+		id := seedExpense(t).Id
+		body := bytes.NewBufferString(fmt.Sprintf(`{"mode": "partial", "operations": [
+			{"op": "create", "expense": {"title": "batch one", "amount": 10}},
+			{"op": "create", "expense": {"title": "batch two", "amount": 20}},
+			{"op": "delete", "id": %d},
+			{"op": "delete", "id": %d}
+		]}`, id, id))
+		var batch BatchResponse
+
+		res := util.Request(http.MethodPost, util.Uri("expenses:batch"), body)
+		err := res.Decode(&batch)
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusMultiStatus, res.StatusCode)
+		assert.Equal(t, 3, batch.Succeeded)
+		if assert.Len(t, batch.Results, 4) {
+			assert.Equal(t, http.StatusCreated, batch.Results[1].Status)
+			assert.Less(t, batch.Results[0].Id, batch.Results[1].Id)
+			assert.Equal(t, http.StatusNotFound, batch.Results[3].Status)
+		}
+	})
+
+	t.Run("TestDeleteAndRestoreExpense", func(t *testing.T) {
+		id := strconv.Itoa(seedExpense(t).Id)
+
+		res := util.Request(http.MethodDelete, util.Uri("expenses", id), nil)
+		assert.Nil(t, res.Err)
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+		res = util.Request(http.MethodGet, util.Uri("expenses", id), nil)
+		assert.Nil(t, res.Err)
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+		var trash []Expense
+		res = util.Request(http.MethodGet, util.Uri("expenses", "trash"), nil)
+		err := res.Decode(&trash)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Greater(t, len(trash), 0)
+
+		var restored Expense
+		res = util.Request(http.MethodPost, util.Uri("expenses", id, "restore"), nil)
+		err = res.Decode(&restored)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, id, strconv.Itoa(restored.Id))
+	})
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	err := eh.Shutdown(ctx)
@@ -5,15 +5,29 @@ package expense
 
 // unit test
 import (
+	"context"
+	"database/sql"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"github.com/teerit/assessment/apierror"
+	"github.com/teerit/assessment/auth"
+	"github.com/teerit/assessment/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
 )
 
 var (
@@ -32,6 +46,20 @@ var (
 	}`
 )
 
+var (
+	testPrincipal = &auth.Principal{Subject: "user-1"}
+	testTime      = time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC)
+
+	expenseColumnNames = strings.Split(strings.ReplaceAll(expenseColumns, " ", ""), ",")
+)
+
+// newContext returns a context authenticated as testPrincipal.
+func newContext(e *echo.Echo, req *http.Request, rec *httptest.ResponseRecorder) echo.Context {
+	c := e.NewContext(req, rec)
+	c.Set(auth.ContextKey, testPrincipal)
+	return c
+}
+
 func testWrapper(jsonString string) (*http.Request, *httptest.ResponseRecorder, *echo.Echo) {
 	e := echo.New()
 	req := httptest.NewRequest(http.MethodGet, "/expenses", strings.NewReader(jsonString))
@@ -40,11 +68,20 @@ func testWrapper(jsonString string) (*http.Request, *httptest.ResponseRecorder,
 	return req, rec, e
 }
 
+// serve runs h the way echo does, rendering a returned error with the
+// central error handler.
+func serve(c echo.Context, h echo.HandlerFunc) error {
+	if err := h(c); err != nil {
+		apierror.HTTPErrorHandler(err, c)
+	}
+	return nil
+}
+
 func TestExpenseModelNotNil(t *testing.T) {
 	exp := &Expense{
 		Id:     1,
 		Title:  "buy a new phone",
-		Amount: 39000,
+		Amount: 39000 * Baht,
 		Note:   "buy a new phone",
 		Tags:   []string{"gadget", "shopping"},
 	}
@@ -52,7 +89,7 @@ func TestExpenseModelNotNil(t *testing.T) {
 	if assert.NotNil(t, exp) {
 		assert.Equal(t, 1, exp.Id)
 		assert.Equal(t, "buy a new phone", exp.Title)
-		assert.Equal(t, 39000.00, exp.Amount)
+		assert.Equal(t, 39000*Baht, exp.Amount)
 		assert.Equal(t, "buy a new phone", exp.Note)
 		assert.Equal(t, []string{"gadget", "shopping"}, exp.Tags)
 	}
@@ -60,7 +97,7 @@ func TestExpenseModelNotNil(t *testing.T) {
 
 func TestExpenseHandler(t *testing.T) {
 	db, _, err := sqlmock.New()
-	con := ExpenseHandler(db)
+	con := ExpenseHandler(NewPostgresStore(db))
 	if assert.NoError(t, err) {
 		assert.NotNil(t, con)
 	}
@@ -76,19 +113,37 @@ func TestExpenseCreate(t *testing.T) {
 		{
 			name:         "TestExpenseCreateSuccess",
 			expectedCode: http.StatusCreated,
-			mockRows:     sqlmock.NewRows([]string{"id"}).AddRow("1"),
+			mockRows:     sqlmock.NewRows([]string{"id", "spent_at", "created_at", "updated_at", "version"}).AddRow("1", testTime, testTime, testTime, 1),
 			json:         expenseJson,
 		},
 		{
 			name:         "TestExpenseCreateBadRequest",
 			expectedCode: http.StatusBadRequest,
-			mockRows:     sqlmock.NewRows([]string{"id"}).AddRow("1"),
+			mockRows:     sqlmock.NewRows([]string{"id", "spent_at", "created_at", "updated_at", "version"}).AddRow("1", testTime, testTime, testTime, 1),
 			json:         expenseBadRequestJson,
 		},
+		{
+			name:         "TestExpenseCreateNegativeAmount",
+			expectedCode: http.StatusBadRequest,
+			mockRows:     sqlmock.NewRows([]string{"id", "spent_at", "created_at", "updated_at", "version"}).AddRow("1", testTime, testTime, testTime, 1),
+			json:         `{"title": "refund", "amount": -79, "note": "", "tags": []}`,
+		},
+		{
+			name:         "TestExpenseCreateOverPreciseAmount",
+			expectedCode: http.StatusBadRequest,
+			mockRows:     sqlmock.NewRows([]string{"id", "spent_at", "created_at", "updated_at", "version"}).AddRow("1", testTime, testTime, testTime, 1),
+			json:         `{"title": "strawberry smoothie", "amount": 79.505, "note": "", "tags": []}`,
+		},
+		{
+			name:         "TestExpenseCreateInvalid",
+			expectedCode: http.StatusUnprocessableEntity,
+			mockRows:     sqlmock.NewRows([]string{"id", "spent_at", "created_at", "updated_at", "version"}).AddRow("1", testTime, testTime, testTime, 1),
+			json:         `{"title": " ", "amount": 0, "note": "", "tags": ["food", " "]}`,
+		},
 		{
 			name:         "TestExpenseCreateInternalServerError",
 			expectedCode: http.StatusInternalServerError,
-			mockRows:     sqlmock.NewRows([]string{"id"}).AddRow("xxx"),
+			mockRows:     sqlmock.NewRows([]string{"id", "spent_at", "created_at", "updated_at", "version"}).AddRow("xxx", testTime, testTime, testTime, 1),
 			json:         expenseJson,
 		},
 	}
@@ -102,17 +157,19 @@ func TestExpenseCreate(t *testing.T) {
 			}
 
 			mock.ExpectQuery(
-				"INSERT INTO expenses \\(title, amount, note, tags\\) values \\(\\$1, \\$2, \\$3, \\$4\\) RETURNING id").
+				"INSERT INTO expenses \\(title, amount, note, tags, owner_id, spent_at\\) values \\(\\$1, \\$2, \\$3, \\$4, \\$5, COALESCE\\(\\$6, now\\(\\)\\)\\) RETURNING (.+)").
 				WithArgs(
 					sqlmock.AnyArg(),
 					sqlmock.AnyArg(),
 					sqlmock.AnyArg(),
+					sqlmock.AnyArg(),
+					"user-1",
 					sqlmock.AnyArg()).WillReturnRows(test.mockRows)
 
-			h := handler{db}
-			c := e.NewContext(req, rec)
+			h := handler{Store: NewPostgresStore(db)}
+			c := newContext(e, req, rec)
 
-			err = h.CreateExpenseHandler(c)
+			err = serve(c, h.CreateExpenseHandler)
 			if assert.NoError(t, err) {
 				assert.Equal(t, test.expectedCode, rec.Code)
 			}
@@ -132,16 +189,16 @@ func TestExpenseGetById(t *testing.T) {
 			name:         "TestExpenseGetSuccess",
 			paramValue:   "1",
 			expectedCode: http.StatusOK,
-			expectedBody: "{\"id\":1,\"title\":\"strawberry smoothie\",\"amount\":79,\"note\":\"night market promotion discount 10 bath\",\"tags\":[\"food\",\"beverage\"]}\n",
-			mockRows: sqlmock.NewRows([]string{"id", "title", "amount", "note", "tags"}).
-				AddRow("1", "strawberry smoothie", "79", "night market promotion discount 10 bath", pq.Array([]string{"food", "beverage"})),
+			expectedBody: "{\"id\":1,\"title\":\"strawberry smoothie\",\"amount\":79,\"note\":\"night market promotion discount 10 bath\",\"tags\":[\"food\",\"beverage\"],\"owner_id\":\"user-1\",\"spent_at\":\"2022-12-01T10:00:00Z\",\"created_at\":\"2022-12-01T10:00:00Z\",\"updated_at\":\"2022-12-01T10:00:00Z\"}\n",
+			mockRows: sqlmock.NewRows(expenseColumnNames).
+				AddRow("1", "strawberry smoothie", "79", "night market promotion discount 10 bath", pq.Array([]string{"food", "beverage"}), "user-1", testTime, testTime, testTime, 1),
 		},
 		{
 			name:         "TestExpenseGetNotFound",
 			paramValue:   "1",
 			expectedCode: http.StatusNotFound,
-			expectedBody: "{\"message\":\"expense not found with given id\"}\n",
-			mockRows:     sqlmock.NewRows([]string{"id", "title", "amount", "note", "tags"}),
+			expectedBody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"expense not found with given id","instance":"/expenses","code":"EXPENSE_NOT_FOUND"}`,
+			mockRows:     sqlmock.NewRows(expenseColumnNames),
 		},
 	}
 
@@ -155,15 +212,15 @@ func TestExpenseGetById(t *testing.T) {
 			}
 
 			mock.ExpectQuery(
-				"SELECT (.+) FROM expenses WHERE id=\\$1").WithArgs(sqlmock.AnyArg()).
+				"SELECT (.+) FROM expenses WHERE id=\\$1 AND deleted_at IS NULL AND owner_id=\\$2").WithArgs(sqlmock.AnyArg(), "user-1").
 				WillReturnRows(test.mockRows)
 
-			h := handler{db}
-			c := e.NewContext(req, rec)
+			h := handler{Store: NewPostgresStore(db)}
+			c := newContext(e, req, rec)
 			c.SetPath("/expenses/:id")
 			c.SetParamNames("id")
 			c.SetParamValues(test.paramValue)
-			err = h.GetExpenseByIdHandler(c)
+			err = serve(c, h.GetExpenseByIdHandler)
 
 			if assert.NoError(t, err) {
 				assert.Equal(t, test.expectedCode, rec.Code)
@@ -187,7 +244,7 @@ func TestExpenseUpdateById(t *testing.T) {
 			requestBody:    expenseJson,
 			pathParam:      "1",
 			tags:           []string{"food", "beverage"},
-			expected:       "{\"id\":1,\"title\":\"strawberry smoothie\",\"amount\":79,\"note\":\"night market promotion discount 10 bath\",\"tags\":[\"food\",\"beverage\"]}\n",
+			expected:       "{\"id\":1,\"title\":\"strawberry smoothie\",\"amount\":79,\"note\":\"night market promotion discount 10 bath\",\"tags\":[\"food\",\"beverage\"],\"owner_id\":\"user-1\",\"spent_at\":\"2022-12-01T10:00:00Z\",\"created_at\":\"2022-12-01T10:00:00Z\",\"updated_at\":\"2022-12-01T10:00:00Z\"}\n",
 			expectedStatus: http.StatusOK,
 		},
 		{
@@ -195,7 +252,7 @@ func TestExpenseUpdateById(t *testing.T) {
 			requestBody:    expenseJson,
 			pathParam:      "",
 			tags:           []string{"food", "beverage"},
-			expected:       "{\"message\":\"strconv.Atoi: parsing \\\"\\\": invalid syntax\"}\n",
+			expected:       `{"type":"about:blank","title":"Bad Request","status":400,"detail":"id should be int","instance":"/expenses","code":"BAD_REQUEST"}`,
 			expectedStatus: http.StatusBadRequest,
 		},
 	}
@@ -205,24 +262,28 @@ func TestExpenseUpdateById(t *testing.T) {
 			req, rec, e := testWrapper(test.requestBody)
 
 			db, mock, err := sqlmock.New()
-			stmt := mock.ExpectPrepare("UPDATE expenses SET title=\\$2, amount=\\$3, note=\\$4, tags=\\$5 WHERE id=\\$1")
-			stmt.ExpectExec().
+			stmt := mock.ExpectPrepare("UPDATE expenses SET title=\\$2, amount=\\$3, note=\\$4, tags=\\$5, spent_at=COALESCE\\(\\$6, spent_at\\), updated_at=now\\(\\), version=version\\+1 WHERE id=\\$1")
+			stmt.ExpectQuery().
 				WithArgs(
 					1,
 					"strawberry smoothie",
-					79.00,
+					79*Baht,
 					"night market promotion discount 10 bath",
-					pq.Array(test.tags)).WillReturnResult(sqlmock.NewResult(1, 1))
+					pq.Array(test.tags),
+					sql.NullTime{},
+					"user-1").
+				WillReturnRows(sqlmock.NewRows([]string{"owner_id", "spent_at", "created_at", "updated_at", "version"}).
+					AddRow("user-1", testTime, testTime, testTime, 1))
 
 			if err != nil {
 				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 			}
-			h := handler{db}
-			c := e.NewContext(req, rec)
+			h := handler{Store: NewPostgresStore(db)}
+			c := newContext(e, req, rec)
 			c.SetPath("/expenses/:id")
 			c.SetParamNames("id")
 			c.SetParamValues(test.pathParam)
-			err = h.UpdateExpenseHandler(c)
+			err = serve(c, h.UpdateExpenseHandler)
 
 			// assertion
 			if assert.NoError(t, err) {
@@ -245,7 +306,7 @@ func TestExpenseGetAll(t *testing.T) {
 			name:           "TestExpenseGetAllSuccess",
 			requestBody:    "",
 			tags:           []string{"food", "beverage"},
-			expected:       "[{\"id\":1,\"title\":\"strawberry smoothie\",\"amount\":79,\"note\":\"night market promotion discount 10 bath\",\"tags\":[\"food\",\"beverage\"]}]",
+			expected:       "[{\"id\":1,\"title\":\"strawberry smoothie\",\"amount\":79,\"note\":\"night market promotion discount 10 bath\",\"tags\":[\"food\",\"beverage\"],\"owner_id\":\"user-1\",\"spent_at\":\"2022-12-01T10:00:00Z\",\"created_at\":\"2022-12-01T10:00:00Z\",\"updated_at\":\"2022-12-01T10:00:00Z\"}]",
 			expectedStatus: http.StatusOK,
 		},
 	}
@@ -254,18 +315,18 @@ func TestExpenseGetAll(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			req, rec, e := testWrapper(test.requestBody)
 
-			mockRows := sqlmock.NewRows([]string{"id", "title", "amount", "note", "tags"}).
-				AddRow("1", "strawberry smoothie", "79", "night market promotion discount 10 bath", pq.Array(&test.tags))
+			mockRows := sqlmock.NewRows(expenseColumnNames).
+				AddRow("1", "strawberry smoothie", "79", "night market promotion discount 10 bath", pq.Array(&test.tags), "user-1", testTime, testTime, testTime, 1)
 
 			db, mock, err := sqlmock.New()
 			mock.ExpectQuery("SELECT (.+) FROM expenses").WillReturnRows(mockRows)
 			if err != nil {
 				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 			}
-			h := handler{db}
-			c := e.NewContext(req, rec)
+			h := handler{Store: NewPostgresStore(db)}
+			c := newContext(e, req, rec)
 
-			err = h.GetExpensesHandler(c)
+			err = serve(c, h.GetExpensesHandler)
 			if assert.NoError(t, err) {
 				assert.Equal(t, test.expectedStatus, rec.Code)
 				assert.Equal(t, test.expected, strings.TrimSpace(rec.Body.String()))
@@ -273,3 +334,1063 @@ func TestExpenseGetAll(t *testing.T) {
 		})
 	}
 }
+
+func TestExpenseGetAllInterrupted(t *testing.T) {
+	tests := []struct {
+		name     string
+		cancel   bool
+		expected string
+		status   int
+	}{
+		{
+			name:     "TestExpenseGetAllTimeout",
+			status:   http.StatusServiceUnavailable,
+			expected: `{"type":"about:blank","title":"Service Unavailable","status":503,"detail":"the database did not respond in time, retry later","instance":"/expenses","code":"DATABASE_TIMEOUT"}`,
+		},
+		{
+			name:     "TestExpenseGetAllClientCanceled",
+			cancel:   true,
+			status:   apierror.StatusClientClosedRequest,
+			expected: `{"type":"about:blank","title":"Client Closed Request","status":499,"detail":"request was canceled by the client","instance":"/expenses","code":"CLIENT_CLOSED_REQUEST"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, rec, e := testWrapper("")
+			if test.cancel {
+				ctx, cancel := context.WithCancel(req.Context())
+				cancel()
+				req = req.WithContext(ctx)
+			}
+
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			mock.ExpectQuery("SELECT (.+) FROM expenses").WillDelayFor(time.Second).
+				WillReturnRows(sqlmock.NewRows(expenseColumnNames))
+
+			store := NewPostgresStore(db)
+			store.Timeout = 10 * time.Millisecond
+			h := handler{Store: store}
+			c := newContext(e, req, rec)
+
+			err = serve(c, h.GetExpensesHandler)
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.status, rec.Code)
+				assert.Equal(t, test.expected, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestExpenseDeleteById(t *testing.T) {
+	tests := []struct {
+		name           string
+		pathParam      string
+		rowsAffected   int64
+		expectedStatus int
+	}{
+		{
+			name:           "TestExpenseDeleteSuccess",
+			pathParam:      "1",
+			rowsAffected:   1,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "TestExpenseDeleteNotFound",
+			pathParam:      "1",
+			rowsAffected:   0,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "TestExpenseDeleteBadRequest",
+			pathParam:      "xxx",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, rec, e := testWrapper("")
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			mock.ExpectExec("UPDATE expenses SET deleted_at=now\\(\\) WHERE id=\\$1 AND deleted_at IS NULL").
+				WithArgs(1, "user-1").WillReturnResult(sqlmock.NewResult(0, test.rowsAffected))
+
+			h := handler{Store: NewPostgresStore(db)}
+			c := newContext(e, req, rec)
+			c.SetPath("/expenses/:id")
+			c.SetParamNames("id")
+			c.SetParamValues(test.pathParam)
+			err = serve(c, h.DeleteExpenseHandler)
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expectedStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestExpenseGetTrash(t *testing.T) {
+	req, rec, e := testWrapper("")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	deletedAt := time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC)
+	mockRows := sqlmock.NewRows(append(expenseColumnNames, "deleted_at")).
+		AddRow("1", "strawberry smoothie", "79", "night market promotion discount 10 bath", pq.Array([]string{"food", "beverage"}), "user-1", testTime, testTime, testTime, 1, deletedAt)
+	mock.ExpectQuery("SELECT (.+) FROM expenses WHERE deleted_at IS NOT NULL").WillReturnRows(mockRows)
+
+	h := handler{Store: NewPostgresStore(db)}
+	c := newContext(e, req, rec)
+	err = serve(c, h.GetTrashHandler)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "[{\"id\":1,\"title\":\"strawberry smoothie\",\"amount\":79,\"note\":\"night market promotion discount 10 bath\",\"tags\":[\"food\",\"beverage\"],\"owner_id\":\"user-1\",\"spent_at\":\"2022-12-01T10:00:00Z\",\"created_at\":\"2022-12-01T10:00:00Z\",\"updated_at\":\"2022-12-01T10:00:00Z\",\"deleted_at\":\"2022-12-01T10:00:00Z\"}]", strings.TrimSpace(rec.Body.String()))
+	}
+}
+
+func TestExpenseRestoreById(t *testing.T) {
+	tests := []struct {
+		name           string
+		mockRows       *sqlmock.Rows
+		expectedStatus int
+	}{
+		{
+			name: "TestExpenseRestoreSuccess",
+			mockRows: sqlmock.NewRows(expenseColumnNames).
+				AddRow("1", "strawberry smoothie", "79", "night market promotion discount 10 bath", pq.Array([]string{"food", "beverage"}), "user-1", testTime, testTime, testTime, 1),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "TestExpenseRestoreNotFound",
+			mockRows:       sqlmock.NewRows(expenseColumnNames),
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, rec, e := testWrapper("")
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			mock.ExpectQuery("UPDATE expenses SET deleted_at=NULL WHERE id=\\$1 AND deleted_at IS NOT NULL AND owner_id=\\$2 RETURNING (.+)").
+				WithArgs(1, "user-1").WillReturnRows(test.mockRows)
+
+			h := handler{Store: NewPostgresStore(db)}
+			c := newContext(e, req, rec)
+			c.SetPath("/expenses/:id/restore")
+			c.SetParamNames("id")
+			c.SetParamValues("1")
+			err = serve(c, h.RestoreExpenseHandler)
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expectedStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestExpensePurgeTrash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	now := time.Date(2022, 12, 31, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("DELETE FROM expenses WHERE deleted_at IS NOT NULL AND deleted_at < \\$1").
+		WithArgs(now.Add(-DefaultTrashRetention), "user-1").WillReturnResult(sqlmock.NewResult(0, 3))
+
+	h := ExpenseHandler(NewPostgresStore(db))
+	n, err := h.PurgeTrash(context.Background(), Scope{Owner: "user-1"}, now)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(3), n)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	}
+}
+
+func TestExpenseListQuerySQL(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		expectedSQL  string
+		expectedArgs []interface{}
+	}{
+		{
+			name:         "TestListQueryDefault",
+			query:        "",
+			expectedSQL:  "SELECT id, title, amount, note, tags, owner_id, spent_at, created_at, updated_at, version FROM expenses WHERE deleted_at IS NULL AND owner_id=$1 ORDER BY id ASC",
+			expectedArgs: []interface{}{"user-1"},
+		},
+		{
+			name:         "TestListQueryFilters",
+			query:        "tag=food&min_amount=10&max_amount=100.5&q=smoothie&limit=5",
+			expectedSQL:  "SELECT id, title, amount, note, tags, owner_id, spent_at, created_at, updated_at, version FROM expenses WHERE deleted_at IS NULL AND $1 = ANY(tags) AND amount >= $2 AND amount <= $3 AND (title ILIKE $4 OR note ILIKE $4) AND owner_id=$5 ORDER BY id ASC LIMIT $6",
+			expectedArgs: []interface{}{"food", 10 * Baht, 100*Baht + 50*Satang, "%smoothie%", "user-1", 6},
+		},
+		{
+			name:         "TestListQueryTextIsLiteral",
+			query:        "q=" + url.QueryEscape(`50%_off\`),
+			expectedSQL:  "SELECT id, title, amount, note, tags, owner_id, spent_at, created_at, updated_at, version FROM expenses WHERE deleted_at IS NULL AND (title ILIKE $1 OR note ILIKE $1) AND owner_id=$2 ORDER BY id ASC",
+			expectedArgs: []interface{}{`%50\%\_off\\%`, "user-1"},
+		},
+		{
+			name:         "TestListQuerySpentRange",
+			query:        "spent_from=2022-12-01&spent_to=2022-12-31T17:00:00Z",
+			expectedSQL:  "SELECT id, title, amount, note, tags, owner_id, spent_at, created_at, updated_at, version FROM expenses WHERE deleted_at IS NULL AND spent_at >= $1 AND spent_at < $2 AND owner_id=$3 ORDER BY id ASC",
+			expectedArgs: []interface{}{time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 12, 31, 17, 0, 0, 0, time.UTC), "user-1"},
+		},
+		{
+			name:         "TestListQuerySortDescWithCursor",
+			query:        "sort=-amount&cursor=" + Cursor{Sort: "-amount", Value: "79.00", Id: 3}.Encode(),
+			expectedSQL:  "SELECT id, title, amount, note, tags, owner_id, spent_at, created_at, updated_at, version FROM expenses WHERE deleted_at IS NULL AND owner_id=$1 AND (amount, id) < ($2, $3) ORDER BY amount DESC, id DESC LIMIT $4",
+			expectedArgs: []interface{}{"user-1", "79.00", 3, DefaultPageLimit + 1},
+		},
+		{
+			name:         "TestListQueryIdCursor",
+			query:        "sort=id&cursor=" + Cursor{Sort: "id", Value: 3, Id: 3}.Encode(),
+			expectedSQL:  "SELECT id, title, amount, note, tags, owner_id, spent_at, created_at, updated_at, version FROM expenses WHERE deleted_at IS NULL AND owner_id=$1 AND id > $2 ORDER BY id ASC LIMIT $3",
+			expectedArgs: []interface{}{"user-1", 3, DefaultPageLimit + 1},
+		},
+		{
+			name:         "TestListQueryIdDescCursor",
+			query:        "sort=-id&cursor=" + Cursor{Sort: "-id", Value: 3, Id: 3}.Encode(),
+			expectedSQL:  "SELECT id, title, amount, note, tags, owner_id, spent_at, created_at, updated_at, version FROM expenses WHERE deleted_at IS NULL AND owner_id=$1 AND id < $2 ORDER BY id DESC LIMIT $3",
+			expectedArgs: []interface{}{"user-1", 3, DefaultPageLimit + 1},
+		},
+		{
+			name:         "TestListQueryFilterExpr",
+			query:        "tag=food&filter=" + url.QueryEscape(`(tags:Food OR tags:beverage) AND amount>50 AND NOT note contains '10%'`),
+			expectedSQL:  "SELECT id, title, amount, note, tags, owner_id, spent_at, created_at, updated_at, version FROM expenses WHERE deleted_at IS NULL AND $1 = ANY(tags) AND ((($2 = ANY(tags) OR $3 = ANY(tags)) AND amount > $4) AND NOT (note ILIKE $5)) AND owner_id=$6 ORDER BY id ASC",
+			expectedArgs: []interface{}{"food", "food", "beverage", 50 * Baht, `%10\%%`, "user-1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/expenses?"+test.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			q, err := ParseListQuery(c)
+			q.Scope = Scope{Owner: "user-1"}
+			if assert.NoError(t, err) {
+				stmt, args := q.SQL()
+				assert.Equal(t, test.expectedSQL, stmt)
+				assert.Equal(t, test.expectedArgs, args)
+			}
+		})
+	}
+}
+
+func TestExpenseListQueryBadRequest(t *testing.T) {
+	for _, query := range []string{
+		"sort=note", "limit=0", "limit=1000", "cursor=xxx", "min_amount=abc", "spent_from=yesterday",
+		"sort=amount&cursor=" + Cursor{Sort: "title", Value: "smoothie", Id: 3}.Encode(),
+		"sort=-amount&cursor=" + Cursor{Sort: "amount", Value: "79.00", Id: 3}.Encode(),
+		"sort=amount&cursor=" + Cursor{Value: "79.00", Id: 3}.Encode(),
+		"sort=amount&cursor=" + Cursor{Sort: "amount", Value: "abc", Id: 3}.Encode(),
+		"sort=title&cursor=" + Cursor{Sort: "title", Value: 3, Id: 3}.Encode(),
+	} {
+		t.Run(query, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/expenses?"+query, nil)
+			rec := httptest.NewRecorder()
+			c := newContext(e, req, rec)
+			db, _, _ := sqlmock.New()
+
+			h := handler{Store: NewPostgresStore(db)}
+			err := serve(c, h.GetExpensesHandler)
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusBadRequest, rec.Code)
+			}
+		})
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		filter       string
+		expectedSQL  string
+		expectedArgs []interface{}
+		expectedErr  string
+	}{
+		{
+			name:         "TestFilterPrecedence",
+			filter:       "NOT tags:food OR id=1 AND id=2",
+			expectedSQL:  "(NOT ($1 = ANY(tags)) OR (id = $2 AND id = $3))",
+			expectedArgs: []interface{}{"food", 1, 2},
+		},
+		{
+			name:         "TestFilterDocumentedExample",
+			filter:       "tags:food OR tags:beverage AND amount>50",
+			expectedSQL:  "($1 = ANY(tags) OR ($2 = ANY(tags) AND amount > $3))",
+			expectedArgs: []interface{}{"food", "beverage", 50 * Baht},
+		},
+		{
+			name:         "TestFilterAndBeforeOr",
+			filter:       "id=1 AND id=2 OR id=3",
+			expectedSQL:  "((id = $1 AND id = $2) OR id = $3)",
+			expectedArgs: []interface{}{1, 2, 3},
+		},
+		{
+			name:         "TestFilterParentheses",
+			filter:       `(title:"straw \"berry\"" or note='ส้มตำ') and spent_at>=2022-12-01 and updated_at<2022-12-31T17:00:00Z`,
+			expectedSQL:  "(((title ILIKE $1 OR note = $2) AND spent_at >= $3) AND updated_at < $4)",
+			expectedArgs: []interface{}{`%straw "berry"%`, "ส้มตำ", time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 12, 31, 17, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:         "TestFilterValueIsNeverSQL",
+			filter:       `title="x' OR 1=1 --"`,
+			expectedSQL:  "title = $1",
+			expectedArgs: []interface{}{"x' OR 1=1 --"},
+		},
+		{name: "TestFilterTrailingInput", filter: `title='x'' OR 1=1 --'`, expectedErr: `filter: column 10: unexpected "'"`},
+		{name: "TestFilterUnknownField", filter: "tags:food AND amout>50", expectedErr: `filter: column 15: unknown field "amout"`},
+		{name: "TestFilterUnsupportedOp", filter: "tags>food", expectedErr: "filter: column 5: tags doesn't support >, use one of : contains"},
+		{name: "TestFilterBadValue", filter: "amount > 12.345", expectedErr: `filter: column 10: amount should have at most 2 decimal places: "12.345"`},
+		{name: "TestFilterMissingValue", filter: "amount>", expectedErr: "filter: column 8: expected a value"},
+		{name: "TestFilterMissingOperator", filter: "note 'promo'", expectedErr: "filter: column 6: expected an operator after note"},
+		{name: "TestFilterDanglingAnd", filter: "tags:food AND", expectedErr: "filter: column 14: expected a condition"},
+		{name: "TestFilterUnclosedParen", filter: "(tags:food", expectedErr: "filter: column 1: unclosed ("},
+		{name: "TestFilterUnterminatedString", filter: "note:'promo", expectedErr: "filter: column 6: unterminated string"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expr, err := ParseFilter(test.filter, time.UTC)
+
+			if test.expectedErr != "" {
+				if assert.Error(t, err) {
+					assert.Equal(t, test.expectedErr, err.Error())
+				}
+				return
+			}
+			if assert.NoError(t, err) {
+				args := []interface{}{}
+				stmt := expr.root.sql(func(v interface{}) string {
+					args = append(args, v)
+					return "$" + strconv.Itoa(len(args))
+				})
+				assert.Equal(t, test.expectedSQL, stmt)
+				assert.Equal(t, test.expectedArgs, args)
+			}
+		})
+	}
+}
+
+func TestExpenseGetPage(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/expenses?limit=1&tag=food", nil)
+	rec := httptest.NewRecorder()
+	c := newContext(e, req, rec)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	mockRows := sqlmock.NewRows(expenseColumnNames).
+		AddRow("1", "strawberry smoothie", "79", "night market promotion discount 10 bath", pq.Array([]string{"food", "beverage"}), "user-1", testTime, testTime, testTime, 1).
+		AddRow("2", "apple smoothie", "89", "no discount", pq.Array([]string{"food"}), "user-1", testTime, testTime, testTime, 1)
+	mock.ExpectQuery("SELECT (.+) FROM expenses WHERE (.+) LIMIT \\$3").WithArgs("food", "user-1", 2).WillReturnRows(mockRows)
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM expenses WHERE (.+)").WithArgs("food", "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	h := handler{Store: NewPostgresStore(db)}
+	err = serve(c, h.GetExpensesHandler)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "{\"data\":[{\"id\":1,\"title\":\"strawberry smoothie\",\"amount\":79,\"note\":\"night market promotion discount 10 bath\",\"tags\":[\"food\",\"beverage\"],\"owner_id\":\"user-1\",\"spent_at\":\"2022-12-01T10:00:00Z\",\"created_at\":\"2022-12-01T10:00:00Z\",\"updated_at\":\"2022-12-01T10:00:00Z\"}],\"next_cursor\":\""+Cursor{Sort: "id", Value: 1, Id: 1}.Encode()+"\",\"total\":2}", strings.TrimSpace(rec.Body.String()))
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Money
+		output   string
+		err      string
+	}{
+		{input: "79", expected: 79 * Baht, output: "79"},
+		{input: "79.50", expected: 79*Baht + 50*Satang, output: "79.5"},
+		{input: "0.05", expected: 5 * Satang, output: "0.05"},
+		{input: "79.500", expected: 79*Baht + 50*Satang, output: "79.5"},
+		{input: "79.505", err: "amount 79.505 should have at most 2 decimal places"},
+		{input: "-1", err: "amount -1 should not be negative"},
+		{input: "1e3", err: "amount 1e3 should be a decimal number"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			var m Money
+			err := m.UnmarshalJSON([]byte(test.input))
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expected, m)
+				b, _ := m.MarshalJSON()
+				assert.Equal(t, test.output, string(b))
+			}
+		})
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	var m Money
+	if assert.NoError(t, m.Scan([]byte("1234.56"))) {
+		assert.Equal(t, 1234*Baht+56*Satang, m)
+	}
+	if assert.NoError(t, m.Scan(0.1+0.2)) {
+		assert.Equal(t, 30*Satang, m)
+	}
+	v, _ := m.Value()
+	assert.Equal(t, "0.30", v)
+}
+
+func TestExpenseSummaryQuerySQL(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		expectedSQL  string
+		expectedArgs []interface{}
+	}{
+		{
+			name:         "TestSummaryTotal",
+			query:        "",
+			expectedSQL:  "SELECT count(*), COALESCE(sum(amount), 0), COALESCE(round(avg(amount), 2), 0), COALESCE(min(amount), 0), COALESCE(max(amount), 0) FROM expenses WHERE deleted_at IS NULL AND owner_id=$1",
+			expectedArgs: []interface{}{"user-1"},
+		},
+		{
+			name:         "TestSummaryByTagAndMonth",
+			query:        "group_by=tag,month&tz=Asia/Bangkok&spent_from=2022-12-01",
+			expectedSQL:  "SELECT t.tag, date_trunc('month', spent_at AT TIME ZONE $3), count(*), COALESCE(sum(amount), 0), COALESCE(round(avg(amount), 2), 0), COALESCE(min(amount), 0), COALESCE(max(amount), 0) FROM expenses CROSS JOIN LATERAL unnest(tags) AS t(tag) WHERE deleted_at IS NULL AND spent_at >= $1 AND owner_id=$2 GROUP BY t.tag, date_trunc('month', spent_at AT TIME ZONE $3) ORDER BY t.tag, date_trunc('month', spent_at AT TIME ZONE $3)",
+			expectedArgs: []interface{}{time.Date(2022, 11, 30, 17, 0, 0, 0, time.UTC), "user-1", "Asia/Bangkok"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/expenses/summary?"+test.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			q, err := ParseSummaryQuery(c)
+			q.Filter.Scope = Scope{Owner: "user-1"}
+			if assert.NoError(t, err) {
+				stmt, args := q.SQL()
+				assert.Equal(t, test.expectedSQL, stmt)
+				if assert.Len(t, args, len(test.expectedArgs)) {
+					for i := range args {
+						if ts, ok := args[i].(time.Time); ok {
+							assert.True(t, ts.Equal(test.expectedArgs[i].(time.Time)))
+							continue
+						}
+						assert.Equal(t, test.expectedArgs[i], args[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestExpenseSummaryBadRequest(t *testing.T) {
+	for _, query := range []string{"group_by=year", "group_by=day,month", "tz=Mars/Olympus", "tz=Local", "tz="} {
+		t.Run(query, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/expenses/summary?"+query, nil)
+			rec := httptest.NewRecorder()
+
+			h := ExpenseHandler(NewMemoryStore())
+			err := serve(newContext(e, req, rec), h.GetSummaryHandler)
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusBadRequest, rec.Code)
+			}
+		})
+	}
+}
+
+func TestPostgresCreateBatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		queryErr  error
+		expectErr bool
+	}{
+		{name: "TestCreateBatchCommit"},
+		{name: "TestCreateBatchRollback", queryErr: sql.ErrConnDone, expectErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			mock.ExpectBegin()
+			q := mock.ExpectQuery("(?s)VALUES \\(0, \\$1, .+\\), \\(1, \\$7, .+\\) AS r \\(ord, .+INSERT INTO expenses .+RETURNING .+SELECT v\\.ord, ins\\.id").
+				WithArgs("strawberry smoothie", 79*Baht, "", sqlmock.AnyArg(), "user-1", sqlmock.AnyArg(),
+					"apple smoothie", 89*Baht, "", sqlmock.AnyArg(), "user-1", sqlmock.AnyArg())
+			if test.queryErr != nil {
+				q.WillReturnError(test.queryErr)
+				mock.ExpectRollback()
+			} else {
+				// Rows come back in neither id nor VALUES order.
+				q.WillReturnRows(sqlmock.NewRows([]string{"ord", "id", "spent_at", "created_at", "updated_at", "version"}).
+					AddRow(1, 7, testTime, testTime, testTime, 1).
+					AddRow(0, 8, testTime, testTime, testTime, 1))
+				mock.ExpectCommit()
+			}
+
+			exps := []*Expense{
+				{Title: "strawberry smoothie", Amount: 79 * Baht, OwnerId: "user-1"},
+				{Title: "apple smoothie", Amount: 89 * Baht, OwnerId: "user-1"},
+			}
+			err = NewPostgresStore(db).CreateBatch(context.Background(), exps)
+
+			if test.expectErr {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, 8, exps[0].Id)
+				assert.Equal(t, 7, exps[1].Id)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPostgresUpdateVersionMismatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		currentRows *sqlmock.Rows
+		expectedErr error
+	}{
+		{
+			name: "TestUpdateStaleVersion",
+			currentRows: sqlmock.NewRows(expenseColumnNames).
+				AddRow("1", "strawberry smoothie", "79", "", pq.Array([]string{}), "user-1", testTime, testTime, testTime, 3),
+			expectedErr: ErrVersionMismatch,
+		},
+		{
+			name:        "TestUpdateMissingRow",
+			currentRows: sqlmock.NewRows(expenseColumnNames),
+			expectedErr: ErrNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			mock.ExpectPrepare("UPDATE expenses SET (.+) WHERE id=\\$1 AND deleted_at IS NULL AND owner_id=\\$7 AND version=\\$8").
+				ExpectQuery().WithArgs(1, "strawberry smoothie", 79*Baht, "", pq.Array([]string{}), sql.NullTime{}, "user-1", 2).
+				WillReturnRows(sqlmock.NewRows([]string{"owner_id", "spent_at", "created_at", "updated_at", "version"}))
+			mock.ExpectQuery("SELECT (.+) FROM expenses WHERE id=\\$1").WithArgs(1, "user-1").WillReturnRows(test.currentRows)
+
+			exp := &Expense{Id: 1, Title: "strawberry smoothie", Amount: 79 * Baht, Tags: []string{}, Version: 2}
+			err = NewPostgresStore(db).Update(context.Background(), Scope{Owner: "user-1"}, exp)
+
+			assert.Equal(t, test.expectedErr, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPostgresPatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM expenses WHERE id=\\$1 AND deleted_at IS NULL AND owner_id=\\$2 FOR UPDATE").
+		WithArgs(1, "user-1").
+		WillReturnRows(sqlmock.NewRows(expenseColumnNames).
+			AddRow("1", "strawberry smoothie", "79", "", pq.Array([]string{"food"}), "user-1", testTime, testTime, testTime, 2))
+	mock.ExpectQuery("UPDATE expenses SET note=\\$2, updated_at=now\\(\\), version=version\\+1 WHERE id=\\$1 RETURNING updated_at, version").
+		WithArgs(1, "x").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at", "version"}).AddRow(testTime, 3))
+	mock.ExpectCommit()
+
+	patch := patchWith(func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return mergePatch(doc, map[string]interface{}{"note": "x"}), nil
+	})
+	exp, err := NewPostgresStore(db).Patch(context.Background(), Scope{Owner: "user-1"}, 1, 2, patch)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "x", exp.Note)
+	assert.Equal(t, 79*Baht, exp.Amount)
+	assert.Equal(t, 3, exp.Version)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresSearch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("SELECT (.+), (.+) AS rank FROM expenses WHERE deleted_at IS NULL AND \\(search_vector @@ websearch_to_tsquery\\('simple', \\$1\\) OR \\$2 <% search_text OR search_text LIKE \\$3\\) AND owner_id=\\$4 ORDER BY rank DESC, id DESC LIMIT \\$5").
+		WithArgs("50%_Smoothie", "50%_smoothie", "%50\\%\\_smoothie%", "user-1", 20).
+		WillReturnRows(sqlmock.NewRows(append(expenseColumnNames, "rank")).
+			AddRow("1", "50%_Smoothie", "79", "", pq.Array([]string{"food"}), "user-1", testTime, testTime, testTime, 1, 2.0))
+
+	results, err := NewPostgresStore(db).Search(context.Background(), SearchQuery{Scope: Scope{Owner: "user-1"}, Q: "50%_Smoothie", Limit: 20})
+
+	if assert.NoError(t, err) && assert.Len(t, results, 1) {
+		assert.Equal(t, 1, results[0].Id)
+		assert.Equal(t, 2.0, results[0].Rank)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresExportCSVPages(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	rows := func(from, to int) *sqlmock.Rows {
+		r := sqlmock.NewRows(expenseColumnNames)
+		for id := from; id <= to; id++ {
+			r.AddRow(id, "strawberry smoothie", "79", "", pq.Array([]string{"food"}), "user-1", testTime, testTime, testTime, 1)
+		}
+		return r
+	}
+	mock.ExpectQuery("SELECT (.+) FROM expenses WHERE deleted_at IS NULL AND owner_id=\\$1 ORDER BY id ASC LIMIT \\$2").
+		WithArgs("user-1", exportBatch+1).
+		WillReturnRows(rows(1, exportBatch+1))
+	mock.ExpectQuery("SELECT (.+) FROM expenses WHERE deleted_at IS NULL AND owner_id=\\$1 AND id > \\$2 ORDER BY id ASC LIMIT \\$3").
+		WithArgs("user-1", exportBatch, exportBatch+1).
+		WillReturnRows(rows(exportBatch+1, exportBatch+1))
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/expenses/export.csv", nil)
+	rec := httptest.NewRecorder()
+	err = serve(newContext(e, req, rec), ExpenseHandler(NewPostgresStore(db)).ExportCSVHandler)
+
+	if assert.NoError(t, err) {
+		lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+		if assert.Len(t, lines, exportBatch+2) {
+			assert.True(t, strings.HasPrefix(lines[exportBatch+1], strconv.Itoa(exportBatch+1)+",strawberry smoothie,"))
+		}
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresStatementCache(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	stmt := mock.ExpectPrepare("SELECT (.+) FROM expenses WHERE id=\\$1 AND deleted_at IS NULL AND owner_id=\\$2")
+	for id := 1; id <= 2; id++ {
+		stmt.ExpectQuery().WithArgs(id, "user-1").
+			WillReturnRows(sqlmock.NewRows(expenseColumnNames).
+				AddRow(id, "strawberry smoothie", "79", "", pq.Array([]string{"food"}), "user-1", testTime, testTime, testTime, 1))
+	}
+	stmt.WillBeClosed()
+
+	s := NewPostgresStore(db)
+	for id := 1; id <= 2; id++ {
+		exp, err := s.Get(context.Background(), Scope{Owner: "user-1"}, id)
+		assert.NoError(t, err)
+		assert.Equal(t, id, exp.Id)
+	}
+	assert.NoError(t, s.Close())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresPatchPrepared(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	lock, _ := lockSQL(Scope{Owner: "user-1"}, 1)
+	mock.ExpectPrepare(regexp.QuoteMeta(lock))
+	mock.ExpectBegin()
+	// The transaction runs the cached statement, already prepared on its
+	// connection, and the uncached update as is.
+	mock.ExpectQuery(regexp.QuoteMeta(lock)).WithArgs(1, "user-1").
+		WillReturnRows(sqlmock.NewRows(expenseColumnNames).
+			AddRow("1", "strawberry smoothie", "79", "", pq.Array([]string{"food"}), "user-1", testTime, testTime, testTime, 2))
+	mock.ExpectQuery("UPDATE expenses SET note=\\$2, updated_at=now\\(\\), version=version\\+1 WHERE id=\\$1 RETURNING updated_at, version").
+		WithArgs(1, "x").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at", "version"}).AddRow(testTime, 3))
+	mock.ExpectCommit()
+
+	s := NewPostgresStore(db)
+	s.Timeout = time.Second
+	_, err = s.stmts.prepare(context.Background(), lock)
+	assert.NoError(t, err)
+
+	patch := patchWith(func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return mergePatch(doc, map[string]interface{}{"note": "x"}), nil
+	})
+	exp, err := s.Patch(context.Background(), Scope{Owner: "user-1"}, 1, 2, patch)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "x", exp.Note)
+	assert.Equal(t, 3, exp.Version)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresBatchPrepared runs a partial batch on a pool of one connection,
+// which the transaction holds throughout. Preparing on the pool would wait
+// for the statement timeout.
+func TestPostgresBatchPrepared(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	del, _ := deleteSQL(Scope{Owner: "user-1"}, 1)
+	mock.ExpectPrepare(regexp.QuoteMeta(del))
+	mock.ExpectBegin()
+	mock.ExpectExec("SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("(?s)VALUES \\(0, \\$1, .+\\) AS r \\(ord, .+INSERT INTO expenses").
+		WithArgs("mango smoothie", 69*Baht, "", pq.Array([]string(nil)), "user-1", sql.NullTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"ord", "id", "spent_at", "created_at", "updated_at", "version"}).AddRow(0, 4, testTime, testTime, testTime, 1))
+	mock.ExpectExec("RELEASE SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(del)).WithArgs(1, "user-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("RELEASE SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	s := NewPostgresStore(db)
+	s.Timeout = time.Second
+	_, err = s.stmts.prepare(context.Background(), del)
+	assert.NoError(t, err)
+
+	ops := []BatchOp{
+		{Op: BatchCreate, Expense: &Expense{Title: "mango smoothie", Amount: 69 * Baht, OwnerId: "user-1"}},
+		{Op: BatchDelete, Id: 1},
+	}
+	errs, err := s.Batch(context.Background(), Scope{Owner: "user-1"}, ops, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Equal(t, 4, ops[0].Expense.Id)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStmtCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	mock.ExpectPrepare("SELECT a").WillBeClosed()
+	mock.ExpectPrepare("SELECT b").WillBeClosed()
+	mock.ExpectPrepare("SELECT c").WillBeClosed()
+
+	c := newStmtCache(db)
+	c.size = 2
+	for _, query := range []string{"SELECT a", "SELECT b", "SELECT a", "SELECT c"} {
+		stmt, release := c.get(context.Background(), query)
+		assert.NotNil(t, stmt, query)
+		release()
+	}
+
+	assert.Contains(t, c.stmts, "SELECT a")
+	assert.NotContains(t, c.stmts, "SELECT b")
+	assert.Contains(t, c.stmts, "SELECT c")
+	assert.NoError(t, c.Close())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStmtCacheEvictsInUse(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	mock.ExpectPrepare("SELECT a").WillBeClosed()
+	mock.ExpectPrepare("SELECT b")
+
+	c := newStmtCache(db)
+	c.size = 1
+	_, release := c.get(context.Background(), "SELECT a")
+	_, releaseB := c.get(context.Background(), "SELECT b")
+	releaseB()
+	assert.Error(t, mock.ExpectationsWereMet(), "a statement in use was closed")
+
+	release()
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStmtCacheRemembersFailures(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	mock.ExpectPrepare("SELECT a").WillReturnError(sql.ErrConnDone)
+	mock.ExpectPrepare("SELECT a")
+
+	c := newStmtCache(db)
+	for i := 0; i < 2; i++ {
+		stmt, release := c.get(context.Background(), "SELECT a")
+		assert.Nil(t, stmt)
+		release()
+	}
+
+	c.stmts["SELECT a"].Value.(*cachedStmt).failedAt = time.Now().Add(-prepareRetryDelay)
+	stmt, release := c.get(context.Background(), "SELECT a")
+	assert.NotNil(t, stmt)
+	release()
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	mock.ExpectQuery("SELECT (.+) FROM expenses").
+		WillReturnRows(sqlmock.NewRows(expenseColumnNames).
+			AddRow("1", "strawberry smoothie", "79", "", pq.Array([]string{"food"}), "user-1", testTime, testTime, testTime, 1))
+	mock.ExpectExec("UPDATE expenses SET deleted_at").WillReturnError(sql.ErrConnDone)
+
+	ctx, parent := tracing.Tracer().Start(context.Background(), "GET /expenses/:id")
+	s := NewPostgresStore(db)
+	_, err = s.Get(ctx, Scope{Owner: "user-1"}, 1)
+	assert.NoError(t, err)
+	assert.Error(t, s.Delete(ctx, Scope{Owner: "user-1"}, 1))
+	parent.End()
+
+	spans := sr.Ended()
+	if assert.Len(t, spans, 3) {
+		get, del := spans[0], spans[1]
+		assert.Equal(t, "SELECT", get.Name())
+		assert.Equal(t, parent.SpanContext().SpanID(), get.Parent().SpanID())
+		assert.Contains(t, get.Attributes(), semconv.DBStatement("SELECT "+expenseColumns+" FROM expenses WHERE id=$1 AND deleted_at IS NULL AND owner_id=$2"))
+		assert.Equal(t, codes.Unset, get.Status().Code)
+
+		assert.Equal(t, "UPDATE", del.Name())
+		assert.Equal(t, codes.Error, del.Status().Code)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresIdempotencyReserve(t *testing.T) {
+	tests := []struct {
+		name     string
+		affected int64
+		stored   *sqlmock.Rows
+		expected *IdempotentResponse
+	}{
+		{
+			name:     "TestReserveFreeKey",
+			affected: 1,
+		},
+		{
+			name:     "TestReserveUsedKey",
+			stored:   sqlmock.NewRows([]string{"request_hash", "status", "body"}).AddRow("hash", 201, []byte("{}")),
+			expected: &IdempotentResponse{Hash: "hash", Status: 201, Body: []byte("{}")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			mock.ExpectExec("DELETE FROM idempotency_keys WHERE expires_at < now\\(\\)").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("INSERT INTO idempotency_keys (.+) ON CONFLICT").
+				WithArgs("user-1", "key", "hash", int64(60000)).
+				WillReturnResult(sqlmock.NewResult(0, test.affected))
+			if test.stored != nil {
+				mock.ExpectQuery("SELECT request_hash, status, body FROM idempotency_keys").
+					WithArgs("user-1", "key").
+					WillReturnRows(test.stored)
+			}
+
+			stored, err := NewPostgresIdempotencyStore(db).Reserve(context.Background(), "user-1", "key", "hash", IdempotencyLease)
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, stored)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPostgresIdempotencyComplete(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	mock.ExpectExec("UPDATE idempotency_keys SET status=\\$3, body=\\$4, expires_at=now\\(\\) \\+ \\$5 \\* interval '1 millisecond' WHERE owner_id=\\$1 AND key=\\$2").
+		WithArgs("user-1", "key", 201, []byte("{}"), int64(86400000)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = NewPostgresIdempotencyStore(db).Complete(context.Background(), "user-1", "key", 201, []byte("{}"), DefaultIdempotencyTTL)
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresBatchPartial(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	insertedRows := func(ord, id int) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"ord", "id", "spent_at", "created_at", "updated_at", "version"}).AddRow(ord, id, testTime, testTime, testTime, 1)
+	}
+	createdRow := func(id int) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "spent_at", "created_at", "updated_at", "version"}).AddRow(id, testTime, testTime, testTime, 1)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("(?s)VALUES \\(0, \\$1, .+\\) AS r \\(ord, .+INSERT INTO expenses").
+		WithArgs("mango smoothie", 69*Baht, "", pq.Array([]string(nil)), "user-1", sql.NullTime{}).
+		WillReturnRows(insertedRows(0, 4))
+	mock.ExpectExec("RELEASE SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	// The delete runs after the creates before it and before the ones after it.
+	mock.ExpectExec("SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE expenses SET deleted_at=now\\(\\) WHERE id=\\$1").WithArgs(99, "user-1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	// The two creates after it are inserted together, and one by one once
+	// that fails.
+	mock.ExpectExec("SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("(?s)VALUES \\(0, \\$1, .+\\), \\(1, \\$7, .+\\) AS r \\(ord, .+INSERT INTO expenses").
+		WithArgs("broken", 1*Baht, "", pq.Array([]string(nil)), "user-1", sql.NullTime{},
+			"apple smoothie", 89*Baht, "", pq.Array([]string(nil)), "user-1", sql.NullTime{}).
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO expenses \\(title, (.+) RETURNING").WithArgs("broken", 1*Baht, "", pq.Array([]string(nil)), "user-1", sql.NullTime{}).
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO expenses \\(title, (.+) RETURNING").WithArgs("apple smoothie", 89*Baht, "", pq.Array([]string(nil)), "user-1", sql.NullTime{}).
+		WillReturnRows(createdRow(5))
+	mock.ExpectExec("RELEASE SAVEPOINT batch_op").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	ops := []BatchOp{
+		{Op: BatchCreate, Expense: &Expense{Title: "mango smoothie", Amount: 69 * Baht, OwnerId: "user-1"}},
+		{Op: BatchDelete, Id: 99},
+		{Op: BatchCreate, Expense: &Expense{Title: "broken", Amount: 1 * Baht, OwnerId: "user-1"}},
+		{Op: BatchCreate, Expense: &Expense{Title: "apple smoothie", Amount: 89 * Baht, OwnerId: "user-1"}},
+	}
+	errs, err := NewPostgresStore(db).Batch(context.Background(), Scope{Owner: "user-1"}, ops, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []error{nil, ErrNotFound, sql.ErrConnDone, nil}, errs)
+	assert.Equal(t, 4, ops[0].Expense.Id)
+	assert.Equal(t, 5, ops[3].Expense.Id)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresBatchAtomicOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE expenses SET deleted_at=now\\(\\) WHERE id=\\$1").WithArgs(1, "user-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("(?s)VALUES \\(0, \\$1, .+\\), \\(1, \\$7, .+\\) AS r \\(ord, .+INSERT INTO expenses").
+		WithArgs("mango smoothie", 69*Baht, "", pq.Array([]string(nil)), "user-1", sql.NullTime{},
+			"apple smoothie", 89*Baht, "", pq.Array([]string(nil)), "user-1", sql.NullTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"ord", "id", "spent_at", "created_at", "updated_at", "version"}).
+			AddRow(0, 4, testTime, testTime, testTime, 1).
+			AddRow(1, 5, testTime, testTime, testTime, 1))
+	mock.ExpectExec("UPDATE expenses SET deleted_at=now\\(\\) WHERE id=\\$1").WithArgs(4, "user-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ops := []BatchOp{
+		{Op: BatchDelete, Id: 1},
+		{Op: BatchCreate, Expense: &Expense{Title: "mango smoothie", Amount: 69 * Baht, OwnerId: "user-1"}},
+		{Op: BatchCreate, Expense: &Expense{Title: "apple smoothie", Amount: 89 * Baht, OwnerId: "user-1"}},
+		{Op: BatchDelete, Id: 4},
+	}
+	errs, err := NewPostgresStore(db).Batch(context.Background(), Scope{Owner: "user-1"}, ops, true)
+
+	assert.NoError(t, err)
+	// The last delete removes an expense the batch created before it.
+	assert.Equal(t, []error{nil, nil, nil, nil}, errs)
+	assert.Equal(t, 4, ops[1].Expense.Id)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExpenseValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		exp          Expense
+		expectedTags []string
+		expected     []FieldError
+	}{
+		{
+			name:         "TestValidateNormalizesTags",
+			exp:          Expense{Title: "strawberry smoothie", Amount: 79 * Baht, Tags: []string{" Food", "beverage", "FOOD "}},
+			expectedTags: []string{"food", "beverage"},
+		},
+		{
+			name:         "TestValidateEmpty",
+			exp:          Expense{Tags: []string{}},
+			expectedTags: []string{},
+			expected: []FieldError{
+				{Field: "title", Message: "title is required"},
+				{Field: "amount", Message: "amount should be greater than 0"},
+			},
+		},
+		{
+			name:         "TestValidateTooLong",
+			exp:          Expense{Title: strings.Repeat("ส", MaxTitleLength+1), Amount: 1, Note: strings.Repeat("x", MaxNoteLength+1), Tags: []string{"", strings.Repeat("x", MaxTagLength+1)}},
+			expectedTags: []string{"", strings.Repeat("x", MaxTagLength+1)},
+			expected: []FieldError{
+				{Field: "title", Message: "title should be at most 200 characters"},
+				{Field: "note", Message: "note should be at most 2000 characters"},
+				{Field: "tags", Message: "tags should not be blank"},
+			},
+		},
+		{
+			name:         "TestValidateThaiTitleByRunes",
+			exp:          Expense{Title: strings.Repeat("ส", MaxTitleLength), Amount: 1},
+			expectedTags: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verr := test.exp.Validate()
+
+			assert.Equal(t, test.expectedTags, test.exp.Tags)
+			if test.expected == nil {
+				assert.Nil(t, verr)
+			} else if assert.NotNil(t, verr) {
+				assert.Equal(t, test.expected, verr.Errors)
+			}
+		})
+	}
+}
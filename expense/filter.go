@@ -0,0 +1,417 @@
+package expense
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// MaxFilterLength bounds the filter parameter in characters.
+	MaxFilterLength = 1000
+	// maxFilterDepth bounds the nesting of parentheses and NOT.
+	maxFilterDepth = 20
+)
+
+// FilterError is a filter that can't be parsed or doesn't fit the expense
+// fields. Column is the 1-based character position of the problem.
+type FilterError struct {
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("filter: column %d: %s", e.Column, e.Message)
+}
+
+// FilterExpr is a parsed filter parameter, such as
+//
+//	tags:food OR tags:beverage AND amount>50 AND NOT note contains 'promo'
+//
+// NOT binds tighter than AND, which binds tighter than OR, so the example
+// matches food of any amount. Parentheses group, as in
+//
+//	(tags:food OR tags:beverage) AND amount>50
+//
+// A condition is a field, an operator and a value, which is a bare word or a
+// quoted string. The fields are those of Expense:
+//
+//	tags:v                      the expense has tag v
+//	title, note:v / contains v  the text contains v, ignoring case
+//	title, note = != v          the text is v
+//	id, amount = != > >= < <= v
+//	spent_at, created_at, updated_at = != > >= < <= v, as RFC 3339 or a date
+type FilterExpr struct {
+	root filterNode
+}
+
+// filterNode is a node of the filter AST.
+type filterNode interface {
+	// sql compiles the node, passing every value through arg so that none of
+	// them ends up in the statement itself.
+	sql(arg func(v interface{}) string) string
+	// match is the in-memory equivalent of sql.
+	match(exp Expense) bool
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n andNode) sql(arg func(interface{}) string) string {
+	return "(" + n.left.sql(arg) + " AND " + n.right.sql(arg) + ")"
+}
+
+func (n andNode) match(exp Expense) bool { return n.left.match(exp) && n.right.match(exp) }
+
+type orNode struct{ left, right filterNode }
+
+func (n orNode) sql(arg func(interface{}) string) string {
+	return "(" + n.left.sql(arg) + " OR " + n.right.sql(arg) + ")"
+}
+
+func (n orNode) match(exp Expense) bool { return n.left.match(exp) || n.right.match(exp) }
+
+type notNode struct{ expr filterNode }
+
+func (n notNode) sql(arg func(interface{}) string) string {
+	return "NOT (" + n.expr.sql(arg) + ")"
+}
+
+func (n notNode) match(exp Expense) bool { return !n.expr.match(exp) }
+
+type fieldKind int
+
+const (
+	kindInt fieldKind = iota
+	kindMoney
+	kindText
+	kindTags
+	kindTime
+)
+
+// filterFields are the Expense fields a filter may refer to, by JSON name.
+var filterFields = map[string]fieldKind{
+	"id":         kindInt,
+	"title":      kindText,
+	"amount":     kindMoney,
+	"note":       kindText,
+	"tags":       kindTags,
+	"spent_at":   kindTime,
+	"created_at": kindTime,
+	"updated_at": kindTime,
+}
+
+// filterOps lists the operators each kind of field accepts. ":" is equality
+// for numbers and times.
+var filterOps = map[fieldKind][]string{
+	kindInt:   {":", "=", "!=", ">", ">=", "<", "<="},
+	kindMoney: {":", "=", "!=", ">", ">=", "<", "<="},
+	kindText:  {":", "contains", "=", "!="},
+	kindTags:  {":", "contains"},
+	kindTime:  {":", "=", "!=", ">", ">=", "<", "<="},
+}
+
+// cmpNode is a single condition. field is a key of filterFields and so safe
+// to use as a column name. value is an int, Money, string or time.Time
+// depending on the kind of the field.
+type cmpNode struct {
+	field string
+	kind  fieldKind
+	op    string
+	value interface{}
+}
+
+func (n cmpNode) sql(arg func(interface{}) string) string {
+	switch {
+	case n.kind == kindTags:
+		return arg(n.value) + " = ANY(tags)"
+	case n.kind == kindText && (n.op == ":" || n.op == "contains"):
+		return n.field + ` ILIKE ` + arg("%"+likeEscaper.Replace(n.value.(string))+"%")
+	case n.op == ":":
+		return n.field + " = " + arg(n.value)
+	}
+	return n.field + " " + n.op + " " + arg(n.value)
+}
+
+func (n cmpNode) match(exp Expense) bool {
+	switch n.field {
+	case "tags":
+		return contains(exp.Tags, n.value.(string))
+	case "title", "note":
+		text := exp.Title
+		if n.field == "note" {
+			text = exp.Note
+		}
+		switch n.op {
+		case "=":
+			return text == n.value
+		case "!=":
+			return text != n.value
+		}
+		return strings.Contains(strings.ToLower(text), strings.ToLower(n.value.(string)))
+	case "id":
+		return compare(n.op, exp.Id-n.value.(int))
+	case "amount":
+		return compare(n.op, int(exp.Amount-n.value.(Money)))
+	}
+
+	t, v := map[string]time.Time{"spent_at": exp.SpentAt, "created_at": exp.CreatedAt, "updated_at": exp.UpdatedAt}[n.field], n.value.(time.Time)
+	switch {
+	case t.Before(v):
+		return compare(n.op, -1)
+	case t.After(v):
+		return compare(n.op, 1)
+	}
+	return compare(n.op, 0)
+}
+
+// compare applies op to the sign of the difference of two values.
+func compare(op string, diff int) bool {
+	switch op {
+	case ":", "=":
+		return diff == 0
+	case "!=":
+		return diff != 0
+	case ">":
+		return diff > 0
+	case ">=":
+		return diff >= 0
+	case "<":
+		return diff < 0
+	}
+	return diff <= 0
+}
+
+// ParseFilter parses a filter parameter. Plain dates are midnight in loc.
+func ParseFilter(s string, loc *time.Location) (*FilterExpr, error) {
+	p := &filterParser{src: []rune(s), loc: loc}
+	if len(p.src) > MaxFilterLength {
+		return nil, &FilterError{Column: MaxFilterLength + 1, Message: fmt.Sprintf("filter should be at most %d characters", MaxFilterLength)}
+	}
+
+	root, err := p.orExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, p.errorf(p.pos, "unexpected %q", string(p.src[p.pos]))
+	}
+	return &FilterExpr{root: root}, nil
+}
+
+// filterParser is a recursive descent parser over the runes of a filter.
+type filterParser struct {
+	src []rune
+	pos int
+	loc *time.Location
+}
+
+func (p *filterParser) errorf(pos int, format string, a ...interface{}) error {
+	return &FilterError{Column: pos + 1, Message: fmt.Sprintf(format, a...)}
+}
+
+func (p *filterParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// keyword consumes kw, in any case, when it is the next word.
+func (p *filterParser) keyword(kw string) bool {
+	p.skipSpace()
+	end := p.pos + len(kw)
+	if end > len(p.src) || !strings.EqualFold(string(p.src[p.pos:end]), kw) {
+		return false
+	}
+	if end < len(p.src) && isIdentRune(p.src[end]) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *filterParser) orExpr(depth int) (filterNode, error) {
+	left, err := p.andExpr(depth)
+	for err == nil && p.keyword("OR") {
+		var right filterNode
+		if right, err = p.andExpr(depth); err == nil {
+			left = orNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) andExpr(depth int) (filterNode, error) {
+	left, err := p.unary(depth)
+	for err == nil && p.keyword("AND") {
+		var right filterNode
+		if right, err = p.unary(depth); err == nil {
+			left = andNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) unary(depth int) (filterNode, error) {
+	if depth > maxFilterDepth {
+		return nil, p.errorf(p.pos, "filter is nested too deeply")
+	}
+
+	if p.keyword("NOT") {
+		expr, err := p.unary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{expr}, nil
+	}
+
+	if p.skipSpace(); p.pos < len(p.src) && p.src[p.pos] == '(' {
+		open := p.pos
+		p.pos++
+		expr, err := p.orExpr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.skipSpace(); p.pos >= len(p.src) || p.src[p.pos] != ')' {
+			return nil, p.errorf(open, "unclosed (")
+		}
+		p.pos++
+		return expr, nil
+	}
+	return p.condition()
+}
+
+func (p *filterParser) condition() (filterNode, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) && isIdentRune(p.src[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		if start == len(p.src) {
+			return nil, p.errorf(start, "expected a condition")
+		}
+		return nil, p.errorf(start, "expected a field, got %q", string(p.src[start]))
+	}
+
+	field := string(p.src[start:p.pos])
+	kind, ok := filterFields[field]
+	if !ok {
+		return nil, p.errorf(start, "unknown field %q", field)
+	}
+
+	p.skipSpace()
+	opPos := p.pos
+	op := p.operator()
+	if op == "" {
+		return nil, p.errorf(opPos, "expected an operator after %s", field)
+	}
+	if !containsString(filterOps[kind], op) {
+		return nil, p.errorf(opPos, "%s doesn't support %s, use one of %s", field, op, strings.Join(filterOps[kind], " "))
+	}
+
+	p.skipSpace()
+	valuePos := p.pos
+	raw, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := parseFilterValue(kind, raw, p.loc)
+	if err != nil {
+		return nil, p.errorf(valuePos, "%s %s", field, err)
+	}
+	return cmpNode{field: field, kind: kind, op: op, value: value}, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// operator consumes the next operator, or returns "" when there is none.
+func (p *filterParser) operator() string {
+	if p.keyword("contains") {
+		return "contains"
+	}
+	for _, op := range []string{">=", "<=", "!=", ":", "=", ">", "<"} {
+		end := p.pos + len(op)
+		if end <= len(p.src) && string(p.src[p.pos:end]) == op {
+			p.pos = end
+			return op
+		}
+	}
+	return ""
+}
+
+// value consumes a quoted string, in which a backslash escapes the next
+// character, or a bare word running up to a space or parenthesis.
+func (p *filterParser) value() (string, error) {
+	start := p.pos
+	if p.pos < len(p.src) && (p.src[p.pos] == '\'' || p.src[p.pos] == '"') {
+		quote := p.src[p.pos]
+		var b strings.Builder
+		for p.pos++; p.pos < len(p.src); p.pos++ {
+			switch r := p.src[p.pos]; {
+			case r == '\\' && p.pos+1 < len(p.src):
+				p.pos++
+				b.WriteRune(p.src[p.pos])
+			case r == quote:
+				p.pos++
+				return b.String(), nil
+			default:
+				b.WriteRune(r)
+			}
+		}
+		return "", p.errorf(start, "unterminated string")
+	}
+
+	for p.pos < len(p.src) && !unicode.IsSpace(p.src[p.pos]) && p.src[p.pos] != '(' && p.src[p.pos] != ')' {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf(start, "expected a value")
+	}
+	return string(p.src[start:p.pos]), nil
+}
+
+// parseFilterValue converts the value of a condition to the field's type.
+func parseFilterValue(kind fieldKind, s string, loc *time.Location) (interface{}, error) {
+	switch kind {
+	case kindInt:
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("should be int: %q", s)
+		}
+		return v, nil
+	case kindMoney:
+		v, err := ParseMoney(s)
+		var merr *MoneyError
+		if errors.As(err, &merr) {
+			return nil, fmt.Errorf("%s: %q", merr.Reason, s)
+		}
+		return v, err
+	case kindTags:
+		// Tags are stored normalized.
+		return strings.ToLower(s), nil
+	case kindTime:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			if t, err = time.ParseInLocation("2006-01-02", s, loc); err != nil {
+				return nil, fmt.Errorf("should be RFC 3339 time or date: %q", s)
+			}
+		}
+		return t, nil
+	}
+	return s, nil
+}
@@ -1,51 +1,69 @@
 package expense
 
 import (
-	"database/sql"
 	"net/http"
 	"strconv"
 
 	"github.com/labstack/echo/v4"
-	"github.com/lib/pq"
+	"github.com/teerit/assessment/apierror"
 )
 
 func (h *handler) GetExpenseByIdHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
 	id := c.Param("id")
 
 	rowId, err := strconv.Atoi(id)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, Err{Message: "id should be int " + err.Error()})
+		return apierror.BadRequest("id should be int")
 	}
 
-	row := h.DB.QueryRow("SELECT id, title, amount, note, tags FROM expenses WHERE id=$1", rowId)
-
-	exp := Expense{}
-	err = row.Scan(&exp.Id, &exp.Title, &exp.Amount, &exp.Note, pq.Array(&exp.Tags))
+	exp, err := h.Store.Get(c.Request().Context(), scope, rowId)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusNotFound, Err{Message: "expense not found with given id"})
-		}
-		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		return storeErr(c.Request().Context(), err)
 	}
 
+	c.Response().Header().Set("ETag", exp.ETag())
 	return c.JSON(http.StatusOK, exp)
 }
 
+// GetExpensesHandler lists expenses. Without limit or cursor it keeps the
+// original bare JSON array response; with either it returns an ExpensePage.
 func (h *handler) GetExpensesHandler(c echo.Context) error {
-	exps := []Expense{}
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	q, err := ParseListQuery(c)
+	if err != nil {
+		return queryErr(err)
+	}
+	q.Scope = scope
 
-	rows, err := h.DB.Query("SELECT id, title, amount, note, tags FROM expenses")
+	ctx := c.Request().Context()
+	exps, err := h.Store.List(ctx, q)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+		return storeErr(ctx, err)
 	}
-	for rows.Next() {
-		exp := Expense{}
-		err := rows.Scan(&exp.Id, &exp.Title, &exp.Amount, &exp.Note, pq.Array(&exp.Tags))
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
-		}
-		exps = append(exps, exp)
+
+	if !q.Paginate {
+		return c.JSON(http.StatusOK, exps)
+	}
+
+	page := ExpensePage{Data: exps}
+	if len(exps) > q.Limit {
+		page.Data = exps[:q.Limit]
+		page.NextCursor = q.NextCursor(page.Data[q.Limit-1]).Encode()
+	}
+
+	page.Total, err = h.Store.Count(ctx, q)
+	if err != nil {
+		return storeErr(ctx, err)
 	}
 
-	return c.JSON(http.StatusOK, exps)
+	return c.JSON(http.StatusOK, page)
 }
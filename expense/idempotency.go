@@ -0,0 +1,192 @@
+package expense
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// DefaultIdempotencyTTL is how long a response is kept for replay under its
+// Idempotency-Key.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// IdempotencyLease is how long a key stays reserved for a request in
+// progress. It outlasts any request, and frees the key soon enough when the
+// process dies before the response is stored.
+const IdempotencyLease = time.Minute
+
+// idempotencySweepInterval is how often the memory store drops expired keys
+// that nobody asked for again.
+const idempotencySweepInterval = time.Minute
+
+// MaxIdempotencyKeyLength bounds the Idempotency-Key header.
+const MaxIdempotencyKeyLength = 255
+
+// IdempotentResponse is what is stored under an Idempotency-Key. Status is 0
+// while the first request with the key is still running.
+type IdempotentResponse struct {
+	Hash   string
+	Status int
+	Body   []byte
+}
+
+// IdempotencyStore keeps the responses of requests sent with an
+// Idempotency-Key. Keys are per owner.
+type IdempotencyStore interface {
+	// Reserve claims key for a request with the given hash until lease
+	// passes. It returns nil when the key was free or expired, otherwise the
+	// stored response, which may still be in progress.
+	Reserve(ctx context.Context, owner, key, hash string, lease time.Duration) (*IdempotentResponse, error)
+	// Complete stores the response of the request that reserved key and
+	// keeps it for ttl.
+	Complete(ctx context.Context, owner, key string, status int, body []byte, ttl time.Duration) error
+	// Release frees key so that the request can be retried.
+	Release(ctx context.Context, owner, key string) error
+}
+
+// requestHash identifies a request body. JSON bodies are hashed in a canonical
+// form so whitespace and key order don't matter.
+func requestHash(body []byte) string {
+	if v, err := decodeJSON(body); err == nil {
+		body, _ = json.Marshal(v)
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+type idempotencyKey struct {
+	owner, key string
+}
+
+type idempotencyEntry struct {
+	IdempotentResponse
+	expiresAt time.Time
+}
+
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	rows      map[idempotencyKey]idempotencyEntry
+	lastSweep time.Time
+}
+
+var _ IdempotencyStore = (*memoryIdempotencyStore)(nil)
+
+func NewMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{rows: map[idempotencyKey]idempotencyEntry{}}
+}
+
+func (s *memoryIdempotencyStore) Reserve(ctx context.Context, owner, key, hash string, lease time.Duration) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= idempotencySweepInterval {
+		for k, e := range s.rows {
+			if !e.expiresAt.After(now) {
+				delete(s.rows, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	k := idempotencyKey{owner, key}
+	if e, ok := s.rows[k]; ok && e.expiresAt.After(now) {
+		res := e.IdempotentResponse
+		return &res, nil
+	}
+	s.rows[k] = idempotencyEntry{IdempotentResponse{Hash: hash}, now.Add(lease)}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, owner, key string, status int, body []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := idempotencyKey{owner, key}
+	if e, ok := s.rows[k]; ok {
+		e.Status, e.Body = status, append([]byte(nil), body...)
+		e.expiresAt = time.Now().Add(ttl)
+		s.rows[k] = e
+	}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(ctx context.Context, owner, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.rows, idempotencyKey{owner, key})
+	return nil
+}
+
+type postgresIdempotencyStore struct {
+	DB *sql.DB
+	// Timeout bounds every store call on top of the caller's context.
+	Timeout time.Duration
+	stmts   *stmtCache
+}
+
+var _ IdempotencyStore = (*postgresIdempotencyStore)(nil)
+
+func NewPostgresIdempotencyStore(db *sql.DB) *postgresIdempotencyStore {
+	return &postgresIdempotencyStore{DB: db, Timeout: DefaultStatementTimeout, stmts: newStmtCache(db)}
+}
+
+func (s *postgresIdempotencyStore) db() querier {
+	return traced{q: s.DB, stmts: s.stmts}
+}
+
+// Close closes the prepared statements.
+func (s *postgresIdempotencyStore) Close() error {
+	return s.stmts.Close()
+}
+
+func (s *postgresIdempotencyStore) Reserve(ctx context.Context, owner, key, hash string, lease time.Duration) (*IdempotentResponse, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	if _, err := s.db().ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < now()"); err != nil {
+		return nil, err
+	}
+
+	// The insert only wins when the key is free; a key whose entry expired
+	// since the delete above is taken over as well.
+	res, err := s.db().ExecContext(ctx, `INSERT INTO idempotency_keys (owner_id, key, request_hash, expires_at) VALUES ($1, $2, $3, now() + $4 * interval '1 millisecond')
+		ON CONFLICT (owner_id, key) DO UPDATE SET request_hash=EXCLUDED.request_hash, status=0, body=NULL, expires_at=EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < now()`, owner, key, hash, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return nil, err
+	}
+
+	stored := &IdempotentResponse{}
+	err = s.db().QueryRowContext(ctx, "SELECT request_hash, status, body FROM idempotency_keys WHERE owner_id=$1 AND key=$2", owner, key).
+		Scan(&stored.Hash, &stored.Status, &stored.Body)
+	if err == sql.ErrNoRows {
+		// Released in the meantime, try again.
+		return s.Reserve(ctx, owner, key, hash, lease)
+	}
+	return stored, err
+}
+
+func (s *postgresIdempotencyStore) Complete(ctx context.Context, owner, key string, status int, body []byte, ttl time.Duration) error {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	_, err := s.db().ExecContext(ctx, "UPDATE idempotency_keys SET status=$3, body=$4, expires_at=now() + $5 * interval '1 millisecond' WHERE owner_id=$1 AND key=$2", owner, key, status, body, ttl.Milliseconds())
+	return err
+}
+
+func (s *postgresIdempotencyStore) Release(ctx context.Context, owner, key string) error {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	_, err := s.db().ExecContext(ctx, "DELETE FROM idempotency_keys WHERE owner_id=$1 AND key=$2", owner, key)
+	return err
+}
@@ -0,0 +1,422 @@
+package expense
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ ExpenseStore = (*memoryStore)(nil)
+
+type memoryStore struct {
+	mu     sync.RWMutex
+	nextId int
+	rows   map[int]Expense
+}
+
+// NewMemoryStore returns an empty ExpenseStore kept in memory. It is safe for
+// concurrent use.
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{nextId: 1, rows: map[int]Expense{}}
+}
+
+func (s *memoryStore) Create(ctx context.Context, exp *Expense) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.create(exp)
+	return nil
+}
+
+func (s *memoryStore) CreateBatch(ctx context.Context, exps []*Expense) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, exp := range exps {
+		s.create(exp)
+	}
+	return nil
+}
+
+func (s *memoryStore) create(exp *Expense) {
+	now := time.Now()
+	exp.Id = s.nextId
+	exp.CreatedAt, exp.UpdatedAt, exp.DeletedAt = now, now, nil
+	exp.Version = 1
+	if exp.SpentAt.IsZero() {
+		exp.SpentAt = now
+	}
+	s.nextId++
+	s.rows[exp.Id] = clone(*exp)
+}
+
+func (s *memoryStore) Get(ctx context.Context, scope Scope, id int) (Expense, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	exp, ok := s.rows[id]
+	if !ok || exp.DeletedAt != nil || !scope.OwnedBy(exp) {
+		return Expense{}, ErrNotFound
+	}
+	return clone(exp), nil
+}
+
+func (s *memoryStore) List(ctx context.Context, q ListQuery) ([]Expense, error) {
+	exps, err := s.filter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	less := lessFunc(q.Sort)
+	sort.Slice(exps, func(i, j int) bool {
+		if q.Desc {
+			return less(exps[j], exps[i])
+		}
+		return less(exps[i], exps[j])
+	})
+
+	if q.Cursor != nil {
+		last, err := cursorExpense(q.Sort, *q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		i := sort.Search(len(exps), func(i int) bool {
+			if q.Desc {
+				return less(exps[i], last)
+			}
+			return less(last, exps[i])
+		})
+		exps = exps[i:]
+	}
+
+	if q.Paginate && len(exps) > q.Limit+1 {
+		exps = exps[:q.Limit+1]
+	}
+	return exps, nil
+}
+
+func (s *memoryStore) Count(ctx context.Context, q ListQuery) (int, error) {
+	exps, err := s.filter(q)
+	return len(exps), err
+}
+
+func (s *memoryStore) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []SearchResult{}
+	for _, exp := range s.rows {
+		if exp.DeletedAt != nil || !q.Scope.OwnedBy(exp) {
+			continue
+		}
+		if rank := q.rank(exp); rank > 0 {
+			results = append(results, SearchResult{Expense: clone(exp), Rank: rank})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Id > results[j].Id
+	})
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+func (s *memoryStore) Summary(ctx context.Context, q SummaryQuery) ([]SummaryRow, error) {
+	exps, err := s.filter(q.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct{ tag, period string }
+	groups := map[key]*SummaryRow{}
+	keys := []key{}
+	add := func(k key, amount Money) {
+		r, ok := groups[k]
+		if !ok {
+			r = &SummaryRow{Tag: k.tag, Period: k.period, Min: amount, Max: amount}
+			groups[k] = r
+			keys = append(keys, k)
+		}
+		r.Count++
+		r.Total += amount
+		if amount < r.Min {
+			r.Min = amount
+		}
+		if amount > r.Max {
+			r.Max = amount
+		}
+	}
+
+	for _, exp := range exps {
+		k := key{}
+		if q.Period != "" {
+			k.period = periodStart(exp.SpentAt.In(q.Location), q.Period).Format("2006-01-02")
+		}
+		if !q.GroupByTag {
+			add(k, exp.Amount)
+			continue
+		}
+		for _, tag := range exp.Tags {
+			add(key{tag: tag, period: k.period}, exp.Amount)
+		}
+	}
+	if len(keys) == 0 && !q.GroupByTag && q.Period == "" {
+		return []SummaryRow{{}}, nil
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tag != keys[j].tag {
+			return keys[i].tag < keys[j].tag
+		}
+		return keys[i].period < keys[j].period
+	})
+
+	summary := make([]SummaryRow, 0, len(keys))
+	for _, k := range keys {
+		r := groups[k]
+		r.Average = (r.Total + Money(r.Count)/2) / Money(r.Count)
+		summary = append(summary, *r)
+	}
+	return summary, nil
+}
+
+// periodStart truncates t to the start of its day, Monday-based week or month
+// in t's location.
+func periodStart(t time.Time, period string) time.Time {
+	y, m, d := t.Date()
+	switch period {
+	case "week":
+		d -= (int(t.Weekday()) + 6) % 7
+	case "month":
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func (s *memoryStore) filter(q ListQuery) ([]Expense, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	exps := []Expense{}
+	for _, exp := range s.rows {
+		if exp.DeletedAt == nil && q.Scope.OwnedBy(exp) && q.match(exp) {
+			exps = append(exps, clone(exp))
+		}
+	}
+	return exps, nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, scope Scope, exp *Expense) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(scope, exp)
+}
+
+func (s *memoryStore) update(scope Scope, exp *Expense) error {
+	old, ok := s.rows[exp.Id]
+	if !ok || old.DeletedAt != nil || !scope.OwnedBy(old) {
+		return ErrNotFound
+	}
+	if exp.Version != 0 && exp.Version != old.Version {
+		return ErrVersionMismatch
+	}
+	exp.OwnerId, exp.CreatedAt, exp.UpdatedAt, exp.DeletedAt = old.OwnerId, old.CreatedAt, time.Now(), nil
+	exp.Version = old.Version + 1
+	if exp.SpentAt.IsZero() {
+		exp.SpentAt = old.SpentAt
+	}
+	s.rows[exp.Id] = clone(*exp)
+	return nil
+}
+
+func (s *memoryStore) Patch(ctx context.Context, scope Scope, id int, version int, fn PatchFunc) (Expense, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.rows[id]
+	if !ok || old.DeletedAt != nil || !scope.OwnedBy(old) {
+		return Expense{}, ErrNotFound
+	}
+	if version != 0 && version != old.Version {
+		return Expense{}, ErrVersionMismatch
+	}
+
+	exp := clone(old)
+	changed, err := fn(&exp)
+	if err != nil {
+		return Expense{}, err
+	}
+	if len(changed) == 0 {
+		return clone(old), nil
+	}
+	exp.UpdatedAt = time.Now()
+	exp.Version = old.Version + 1
+	s.rows[id] = clone(exp)
+	return exp, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, scope Scope, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.delete(scope, id)
+}
+
+func (s *memoryStore) delete(scope Scope, id int) error {
+	exp, ok := s.rows[id]
+	if !ok || exp.DeletedAt != nil || !scope.OwnedBy(exp) {
+		return ErrNotFound
+	}
+	now := time.Now()
+	exp.DeletedAt = &now
+	s.rows[id] = exp
+	return nil
+}
+
+func (s *memoryStore) Batch(ctx context.Context, scope Scope, ops []BatchOp, atomic bool) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, nextId := make(map[int]Expense, len(s.rows)), s.nextId
+	for id, exp := range s.rows {
+		rows[id] = exp
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		switch op.Op {
+		case BatchCreate:
+			s.create(op.Expense)
+		case BatchUpdate:
+			errs[i] = s.update(scope, op.Expense)
+		case BatchDelete:
+			errs[i] = s.delete(scope, op.Id)
+		default:
+			errs[i] = fmt.Errorf("unknown batch op %q", op.Op)
+		}
+		if errs[i] != nil && atomic {
+			s.rows, s.nextId = rows, nextId
+			return abortBatch(errs), nil
+		}
+	}
+	return errs, nil
+}
+
+func (s *memoryStore) Trash(ctx context.Context, scope Scope) ([]Expense, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	exps := []Expense{}
+	for _, exp := range s.rows {
+		if exp.DeletedAt != nil && scope.OwnedBy(exp) {
+			exps = append(exps, clone(exp))
+		}
+	}
+	sort.Slice(exps, func(i, j int) bool {
+		return exps[i].DeletedAt.After(*exps[j].DeletedAt)
+	})
+	return exps, nil
+}
+
+func (s *memoryStore) Restore(ctx context.Context, scope Scope, id int) (Expense, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exp, ok := s.rows[id]
+	if !ok || exp.DeletedAt == nil || !scope.OwnedBy(exp) {
+		return Expense{}, ErrNotFound
+	}
+	exp.DeletedAt = nil
+	s.rows[id] = exp
+	return clone(exp), nil
+}
+
+func (s *memoryStore) Purge(ctx context.Context, scope Scope, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for id, exp := range s.rows {
+		if exp.DeletedAt != nil && exp.DeletedAt.Before(before) && scope.OwnedBy(exp) {
+			delete(s.rows, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// clone copies the slice and pointer fields so callers can't modify stored rows.
+func clone(exp Expense) Expense {
+	exp.Tags = append([]string(nil), exp.Tags...)
+	if exp.DeletedAt != nil {
+		t := *exp.DeletedAt
+		exp.DeletedAt = &t
+	}
+	return exp
+}
+
+// match is the in-memory equivalent of Where.
+func (q ListQuery) match(exp Expense) bool {
+	for _, tag := range q.Tags {
+		if !contains(exp.Tags, tag) {
+			return false
+		}
+	}
+	if q.MinAmount != nil && exp.Amount < *q.MinAmount {
+		return false
+	}
+	if q.MaxAmount != nil && exp.Amount > *q.MaxAmount {
+		return false
+	}
+	if q.SpentFrom != nil && exp.SpentAt.Before(*q.SpentFrom) {
+		return false
+	}
+	if q.SpentTo != nil && !exp.SpentAt.Before(*q.SpentTo) {
+		return false
+	}
+	if q.Q != "" {
+		needle := strings.ToLower(q.Q)
+		if !strings.Contains(strings.ToLower(exp.Title), needle) && !strings.Contains(strings.ToLower(exp.Note), needle) {
+			return false
+		}
+	}
+	if q.Expr != nil && !q.Expr.root.match(exp) {
+		return false
+	}
+	return true
+}
+
+func contains(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// lessFunc orders expenses by the sort column with the id as tie breaker.
+func lessFunc(sort string) func(a, b Expense) bool {
+	return func(a, b Expense) bool {
+		switch sort {
+		case "amount":
+			if a.Amount != b.Amount {
+				return a.Amount < b.Amount
+			}
+		case "title":
+			if a.Title != b.Title {
+				return a.Title < b.Title
+			}
+		}
+		return a.Id < b.Id
+	}
+}
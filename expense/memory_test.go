@@ -0,0 +1,918 @@
+//go:build unit
+// +build unit
+
+package expense
+
+import (
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/teerit/assessment/apierror"
+	"github.com/teerit/assessment/auth"
+)
+
+func seedMemoryStore(t *testing.T) *memoryStore {
+	s := NewMemoryStore()
+	for _, exp := range []Expense{
+		{Title: "strawberry smoothie", Amount: 79 * Baht, Note: "night market promotion discount 10 bath", Tags: []string{"food", "beverage"}, OwnerId: "user-1"},
+		{Title: "iPhone 14 Pro Max 1TB", Amount: 66900 * Baht, Note: "birthday gift from my love", Tags: []string{"gadget"}, OwnerId: "user-1"},
+		{Title: "apple smoothie", Amount: 89 * Baht, Note: "no discount", Tags: []string{"beverage"}, OwnerId: "user-1"},
+	} {
+		exp := exp
+		if err := s.Create(context.Background(), &exp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestMemoryStoreCRUD(t *testing.T) {
+	s := seedMemoryStore(t)
+	own := Scope{Owner: "user-1"}
+
+	exp, err := s.Get(context.Background(), own, 1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "strawberry smoothie", exp.Title)
+	}
+
+	exp.Tags[0] = "changed"
+	stored, _ := s.Get(context.Background(), own, 1)
+	assert.Equal(t, "food", stored.Tags[0])
+
+	exp.Title = "mango smoothie"
+	assert.NoError(t, s.Update(context.Background(), own, &exp))
+	stored, _ = s.Get(context.Background(), own, 1)
+	assert.Equal(t, "mango smoothie", stored.Title)
+
+	assert.Equal(t, ErrNotFound, s.Update(context.Background(), own, &Expense{Id: 99}))
+	assert.NoError(t, s.Delete(context.Background(), own, 1))
+	assert.Equal(t, ErrNotFound, s.Delete(context.Background(), own, 1))
+
+	_, err = s.Get(context.Background(), own, 1)
+	assert.Equal(t, ErrNotFound, err)
+
+	trash, _ := s.Trash(context.Background(), own)
+	assert.Len(t, trash, 1)
+
+	restored, err := s.Restore(context.Background(), own, 1)
+	if assert.NoError(t, err) {
+		assert.Nil(t, restored.DeletedAt)
+	}
+
+	assert.NoError(t, s.Delete(context.Background(), own, 2))
+	n, _ := s.Purge(context.Background(), own, time.Now().Add(-time.Hour))
+	assert.Equal(t, int64(0), n)
+	n, _ = s.Purge(context.Background(), own, time.Now().Add(time.Hour))
+	assert.Equal(t, int64(1), n)
+}
+
+func TestMemoryStoreList(t *testing.T) {
+	s := seedMemoryStore(t)
+	min := 80 * Baht
+
+	tests := []struct {
+		name        string
+		query       ListQuery
+		expectedIds []int
+	}{
+		{name: "TestMemoryListAll", query: ListQuery{Scope: Scope{Owner: "user-1"}, Sort: "id"}, expectedIds: []int{1, 2, 3}},
+		{name: "TestMemoryListByTag", query: ListQuery{Scope: Scope{Owner: "user-1"}, Sort: "id", Tags: []string{"beverage"}}, expectedIds: []int{1, 3}},
+		{name: "TestMemoryListMinAmount", query: ListQuery{Scope: Scope{Owner: "user-1"}, Sort: "id", MinAmount: &min}, expectedIds: []int{2, 3}},
+		{name: "TestMemoryListSearch", query: ListQuery{Scope: Scope{Owner: "user-1"}, Sort: "id", Q: "SMOOTHIE"}, expectedIds: []int{1, 3}},
+		{name: "TestMemoryListSortAmountDesc", query: ListQuery{Scope: Scope{Owner: "user-1"}, Sort: "amount", Desc: true}, expectedIds: []int{2, 3, 1}},
+		{name: "TestMemoryListSortTitle", query: ListQuery{Scope: Scope{Owner: "user-1"}, Sort: "title"}, expectedIds: []int{3, 2, 1}},
+		{
+			name:        "TestMemoryListPage",
+			query:       ListQuery{Scope: Scope{Owner: "user-1"}, Sort: "amount", Paginate: true, Limit: 1, Cursor: &Cursor{Value: "79.00", Id: 1}},
+			expectedIds: []int{3, 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exps, err := s.List(context.Background(), test.query)
+			if assert.NoError(t, err) {
+				ids := []int{}
+				for _, exp := range exps {
+					ids = append(ids, exp.Id)
+				}
+				assert.Equal(t, test.expectedIds, ids)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreConcurrentCreate(t *testing.T) {
+	s := NewMemoryStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Create(context.Background(), &Expense{Title: "coffee", Amount: 50 * Baht, OwnerId: "user-1"})
+		}()
+	}
+	wg.Wait()
+
+	n, _ := s.Count(context.Background(), ListQuery{Scope: Scope{All: true}})
+	assert.Equal(t, 50, n)
+}
+
+func TestHandlerWithMemoryStore(t *testing.T) {
+	h := ExpenseHandler(seedMemoryStore(t))
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/expenses?limit=2&sort=-amount", nil)
+	rec := httptest.NewRecorder()
+	err := serve(newContext(e, req, rec), h.GetExpensesHandler)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.True(t, strings.HasPrefix(rec.Body.String(), "{\"data\":[{\"id\":2,"))
+		assert.Contains(t, rec.Body.String(), "\"total\":3")
+	}
+}
+
+func TestHandlerOwnership(t *testing.T) {
+	s := seedMemoryStore(t)
+	other := Expense{Title: "taxi", Amount: 120 * Baht, OwnerId: "user-2"}
+	s.Create(context.Background(), &other)
+	h := ExpenseHandler(s)
+	e := echo.New()
+
+	tests := []struct {
+		name           string
+		principal      *auth.Principal
+		path           string
+		expectedStatus int
+		expectedCount  int
+	}{
+		{name: "TestOwnerGetsOwnExpense", principal: testPrincipal, path: "/expenses/1", expectedStatus: http.StatusOK},
+		{name: "TestOtherOwnerNotFound", principal: testPrincipal, path: "/expenses/4", expectedStatus: http.StatusNotFound},
+		{name: "TestOwnerListsOwnExpenses", principal: testPrincipal, path: "/expenses", expectedStatus: http.StatusOK, expectedCount: 3},
+		{name: "TestAdminGetsAnyExpense", principal: &auth.Principal{Subject: "root", Roles: []string{auth.RoleAdmin}}, path: "/expenses/4", expectedStatus: http.StatusOK},
+		{name: "TestAdminListsAllExpenses", principal: &auth.Principal{Subject: "root", Roles: []string{auth.RoleAdmin}}, path: "/expenses", expectedStatus: http.StatusOK, expectedCount: 4},
+		{name: "TestAdminListsOneOwner", principal: &auth.Principal{Subject: "root", Roles: []string{auth.RoleAdmin}}, path: "/expenses?owner=user-2", expectedStatus: http.StatusOK, expectedCount: 1},
+		{name: "TestAnonymousUnauthorized", path: "/expenses", expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			if test.principal != nil {
+				c.Set(auth.ContextKey, test.principal)
+			}
+
+			var err error
+			if path, id, ok := strings.Cut(test.path, "/expenses/"); ok && path == "" {
+				c.SetParamNames("id")
+				c.SetParamValues(id)
+				err = serve(c, h.GetExpenseByIdHandler)
+			} else {
+				err = serve(c, h.GetExpensesHandler)
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expectedStatus, rec.Code)
+				if test.expectedCount > 0 {
+					assert.Equal(t, test.expectedCount, strings.Count(rec.Body.String(), "\"id\":"))
+				}
+			}
+		})
+	}
+}
+
+func TestSearchExpenses(t *testing.T) {
+	s := seedMemoryStore(t)
+	thai := Expense{Title: "ชานมไข่มุก", Amount: 45 * Baht, Note: "ซื้อโปรโมชั่นลดราคา 1 แถม 1", Tags: []string{"beverage"}, OwnerId: "user-1"}
+	s.Create(context.Background(), &thai)
+	other := Expense{Title: "banana smoothie", Amount: 60 * Baht, OwnerId: "user-2"}
+	s.Create(context.Background(), &other)
+	h := ExpenseHandler(s)
+	e := echo.New()
+
+	tests := []struct {
+		name            string
+		query           string
+		expectedStatus  int
+		expectedIds     []int
+		expectedSnippet string
+	}{
+		{name: "TestSearchWord", query: "q=smoothie", expectedStatus: http.StatusOK, expectedIds: []int{3, 1}, expectedSnippet: "apple <mark>smoothie</mark>"},
+		{name: "TestSearchTypo", query: "q=smoothy", expectedStatus: http.StatusOK, expectedIds: []int{3, 1}, expectedSnippet: "apple <mark>smoothie</mark>"},
+		{name: "TestSearchNoteIgnoresCase", query: "q=DISCOUNT", expectedStatus: http.StatusOK, expectedIds: []int{3, 1}, expectedSnippet: "no <mark>discount</mark>"},
+		{name: "TestSearchThaiInsideWord", query: "q=" + url.QueryEscape("โปรโมชั่น"), expectedStatus: http.StatusOK, expectedIds: []int{4}, expectedSnippet: "ซื้อ<mark>โปรโมชั่น</mark>ลดราคา 1 แถม 1"},
+		{name: "TestSearchLimit", query: "q=smoothie&limit=1", expectedStatus: http.StatusOK, expectedIds: []int{3}, expectedSnippet: "apple <mark>smoothie</mark>"},
+		{name: "TestSearchNoMatch", query: "q=taxi", expectedStatus: http.StatusOK, expectedIds: []int{}},
+		{name: "TestSearchMissingQuery", query: "q=+", expectedStatus: http.StatusBadRequest},
+		{name: "TestSearchTooLong", query: "q=" + strings.Repeat("x", MaxSearchLength+1), expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/expenses/search?"+test.query, nil)
+			rec := httptest.NewRecorder()
+			err := serve(newContext(e, req, rec), h.SearchExpensesHandler)
+
+			if assert.NoError(t, err) && assert.Equal(t, test.expectedStatus, rec.Code) && test.expectedIds != nil {
+				results := SearchResults{}
+				json.Unmarshal(rec.Body.Bytes(), &results)
+
+				ids := []int{}
+				for _, r := range results.Data {
+					ids = append(ids, r.Id)
+				}
+				assert.Equal(t, test.expectedIds, ids)
+				if len(results.Data) > 0 {
+					assert.Equal(t, test.expectedSnippet, results.Data[0].Snippet)
+				}
+			}
+		})
+	}
+}
+
+func TestListFilterExpr(t *testing.T) {
+	h := ExpenseHandler(seedMemoryStore(t))
+	e := echo.New()
+
+	tests := []struct {
+		name           string
+		filter         string
+		expectedStatus int
+		expectedBody   string
+		expectedIds    []int
+	}{
+		{name: "TestFilterTagsAndAmount", filter: "(tags:food OR tags:gadget) AND amount>50", expectedStatus: http.StatusOK, expectedIds: []int{1, 2}},
+		{name: "TestFilterNotNoteContains", filter: "tags:beverage AND NOT note contains 'PROMO'", expectedStatus: http.StatusOK, expectedIds: []int{3}},
+		{name: "TestFilterSpentAt", filter: "spent_at < 2000-01-01", expectedStatus: http.StatusOK, expectedIds: []int{}},
+		{
+			name:           "TestFilterErrorColumn",
+			filter:         "tags:food AND amout>50",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `"code":"INVALID_FILTER","errors":[{"column":15,"message":"unknown field \"amout\""}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/expenses?filter="+url.QueryEscape(test.filter), nil)
+			rec := httptest.NewRecorder()
+			err := serve(newContext(e, req, rec), h.GetExpensesHandler)
+
+			if assert.NoError(t, err) && assert.Equal(t, test.expectedStatus, rec.Code) {
+				assert.Contains(t, rec.Body.String(), test.expectedBody)
+				if test.expectedIds != nil {
+					exps := []Expense{}
+					json.Unmarshal(rec.Body.Bytes(), &exps)
+					ids := []int{}
+					for _, exp := range exps {
+						ids = append(ids, exp.Id)
+					}
+					assert.Equal(t, test.expectedIds, ids)
+				}
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	s, ok := highlight("<b>smoothie</b> & "+strings.Repeat("x", snippetLength)+" smoothie", "smoothie")
+	assert.True(t, ok)
+	assert.True(t, strings.HasPrefix(s, "&lt;b&gt;<mark>smoothie</mark>&lt;/b&gt; &amp; x"), s)
+	assert.True(t, strings.HasSuffix(s, "…"), s)
+
+	s, ok = highlight(strings.Repeat("x ", snippetLength)+"smoothie", "smoothie")
+	assert.True(t, ok)
+	assert.True(t, strings.HasPrefix(s, "…"), s)
+	assert.True(t, strings.HasSuffix(s, "<mark>smoothie</mark>"), s)
+
+	_, ok = highlight("taxi", "smoothie")
+	assert.False(t, ok)
+}
+
+func TestMemoryStoreTimestamps(t *testing.T) {
+	s := NewMemoryStore()
+	own := Scope{Owner: "user-1"}
+	spent := time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC)
+
+	withDate := Expense{Title: "strawberry smoothie", Amount: 79 * Baht, OwnerId: "user-1", SpentAt: spent}
+	withoutDate := Expense{Title: "apple smoothie", Amount: 89 * Baht, OwnerId: "user-1"}
+	s.Create(context.Background(), &withDate)
+	s.Create(context.Background(), &withoutDate)
+
+	assert.Equal(t, spent, withDate.SpentAt)
+	assert.False(t, withoutDate.SpentAt.IsZero())
+	assert.False(t, withDate.CreatedAt.IsZero())
+
+	update := Expense{Id: withDate.Id, Title: "mango smoothie", Amount: 79 * Baht}
+	if assert.NoError(t, s.Update(context.Background(), own, &update)) {
+		assert.Equal(t, spent, update.SpentAt)
+		assert.Equal(t, withDate.CreatedAt, update.CreatedAt)
+		assert.False(t, update.UpdatedAt.Before(withDate.UpdatedAt))
+	}
+
+	from, to := spent.Add(-time.Hour), spent.Add(time.Hour)
+	exps, _ := s.List(context.Background(), ListQuery{Scope: own, Sort: "id", SpentFrom: &from, SpentTo: &to})
+	if assert.Len(t, exps, 1) {
+		assert.Equal(t, withDate.Id, exps[0].Id)
+	}
+}
+
+func TestMemoryStoreSummary(t *testing.T) {
+	s := NewMemoryStore()
+	bkk, _ := time.LoadLocation("Asia/Bangkok")
+	for _, exp := range []Expense{
+		{Amount: 79 * Baht, Tags: []string{"food", "beverage"}, SpentAt: time.Date(2022, 11, 30, 18, 0, 0, 0, time.UTC)},
+		{Amount: 89 * Baht, Tags: []string{"beverage"}, SpentAt: time.Date(2022, 12, 15, 12, 0, 0, 0, time.UTC)},
+		{Amount: 100 * Baht, Tags: []string{"food"}, SpentAt: time.Date(2022, 12, 20, 12, 0, 0, 0, time.UTC)},
+	} {
+		exp := exp
+		exp.OwnerId = "user-1"
+		s.Create(context.Background(), &exp)
+	}
+	filter := ListQuery{Scope: Scope{Owner: "user-1"}}
+
+	total, err := s.Summary(context.Background(), SummaryQuery{Filter: filter, Location: time.UTC})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []SummaryRow{{Count: 3, Total: 268 * Baht, Average: 8933 * Satang, Min: 79 * Baht, Max: 100 * Baht}}, total)
+	}
+
+	byTagMonth, err := s.Summary(context.Background(), SummaryQuery{Filter: filter, GroupByTag: true, Period: "month", Location: bkk})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []SummaryRow{
+			{Tag: "beverage", Period: "2022-12-01", Count: 2, Total: 168 * Baht, Average: 84 * Baht, Min: 79 * Baht, Max: 89 * Baht},
+			{Tag: "food", Period: "2022-12-01", Count: 2, Total: 179 * Baht, Average: 8950 * Satang, Min: 79 * Baht, Max: 100 * Baht},
+		}, byTagMonth)
+	}
+
+	byWeek, err := s.Summary(context.Background(), SummaryQuery{Filter: filter, Period: "week", Location: time.UTC})
+	if assert.NoError(t, err) && assert.Len(t, byWeek, 3) {
+		assert.Equal(t, "2022-11-28", byWeek[0].Period)
+		assert.Equal(t, "2022-12-12", byWeek[1].Period)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	h := ExpenseHandler(seedMemoryStore(t))
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/expenses/export.csv?tag=beverage", nil)
+	rec := httptest.NewRecorder()
+	err := serve(newContext(e, req, rec), h.ExportCSVHandler)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get(echo.HeaderContentType))
+		lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+		if assert.Len(t, lines, 3) {
+			assert.Equal(t, "id,title,amount,note,tags,spent_at,created_at,updated_at", lines[0])
+			assert.True(t, strings.HasPrefix(lines[1], "1,strawberry smoothie,79.00,night market promotion discount 10 bath,food;beverage,"))
+			assert.True(t, strings.HasPrefix(lines[2], "3,apple smoothie,89.00,no discount,beverage,"))
+		}
+	}
+}
+
+func TestExportCSVNeutralisesFormulas(t *testing.T) {
+	s := NewMemoryStore()
+	exp := Expense{Title: "=HYPERLINK(\"http://evil.example\")", Amount: 10 * Baht, Note: "-2+3", Tags: []string{"@home"}, OwnerId: "user-1"}
+	s.Create(context.Background(), &exp)
+	h := ExpenseHandler(s)
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/expenses/export.csv", nil)
+	rec := httptest.NewRecorder()
+	err := serve(newContext(e, req, rec), h.ExportCSVHandler)
+
+	if assert.NoError(t, err) {
+		lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+		if assert.Len(t, lines, 2) {
+			assert.True(t, strings.HasPrefix(lines[1], `1,"'=HYPERLINK(""http://evil.example"")",10.00,'-2+3,'@home,`), lines[1])
+		}
+	}
+
+	// An exported file imports back unchanged.
+	req = httptest.NewRequest(http.MethodPost, "/expenses/import", strings.NewReader(rec.Body.String()))
+	req.Header.Set(echo.HeaderContentType, "text/csv")
+	rec = httptest.NewRecorder()
+	err = serve(newContext(e, req, rec), h.ImportCSVHandler)
+
+	if assert.NoError(t, err) && assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String()) {
+		imported, _ := s.Get(context.Background(), Scope{Owner: "user-1"}, 2)
+		assert.Equal(t, exp.Title, imported.Title)
+		assert.Equal(t, exp.Note, imported.Note)
+		assert.Equal(t, exp.Tags, imported.Tags)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	multipartBody := func(field, csv string) (string, string) {
+		var b strings.Builder
+		w := multipart.NewWriter(&b)
+		f, _ := w.CreateFormFile(field, "expenses.csv")
+		f.Write([]byte(csv))
+		w.Close()
+		return b.String(), w.FormDataContentType()
+	}
+	uploaded, uploadType := multipartBody("file", "title,amount\ncoffee,65\n")
+	misnamed, misnamedType := multipartBody("csv", "title,amount\ncoffee,65\n")
+
+	tests := []struct {
+		name           string
+		query          string
+		contentType    string
+		body           string
+		expectedStatus int
+		expectedBody   string
+		expectedStored int
+	}{
+		{
+			name:           "TestImportSuccess",
+			body:           "title,amount,note,tags,spent_at\nstrawberry smoothie,79,night market,food;beverage,2022-12-01\n\"taxi, airport\",350.50,,,\n",
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `{"dry_run":false,"rows":2,"imported":2,"errors":[]}`,
+			expectedStored: 2,
+		},
+		{
+			name:           "TestImportDryRun",
+			query:          "dry_run=true",
+			body:           "title,amount\nstrawberry smoothie,79\n",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"dry_run":true,"rows":1,"imported":0,"errors":[]}`,
+		},
+		{
+			name:           "TestImportHeaderMapping",
+			query:          "map=title:Description,amount:Total",
+			body:           "Date,Description,Total\n2022-12-01,coffee,65\n",
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `{"dry_run":false,"rows":1,"imported":1,"errors":[]}`,
+			expectedStored: 1,
+		},
+		{
+			name:           "TestImportRowErrors",
+			body:           "title,amount,spent_at\nstrawberry smoothie,79,\n,-5,yesterday\n",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedBody:   `{"type":"about:blank","title":"Unprocessable Entity","status":422,"detail":"1 of 2 rows are invalid","instance":"/expenses/import","code":"VALIDATION_FAILED","errors":[{"line":3,"field":"title","message":"title is required"},{"line":3,"field":"amount","message":"amount -5 should not be negative"},{"line":3,"field":"spent_at","message":"spent_at should be RFC 3339 time or date"}]}`,
+		},
+		{
+			name:           "TestImportMalformedRecord",
+			query:          "dry_run=true",
+			body:           "title,amount\ncof\"fee,65\n\"tea\" x,40\nwater,10\n",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedBody:   `{"type":"about:blank","title":"Unprocessable Entity","status":422,"detail":"2 of 3 rows are invalid","instance":"/expenses/import","code":"VALIDATION_FAILED","errors":[{"line":2,"message":"bare \" in non-quoted-field"},{"line":3,"message":"extraneous or missing \" in quoted-field"}]}`,
+		},
+		{
+			name:           "TestImportMissingColumn",
+			body:           "name,amount\ncoffee,65\n",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"type":"about:blank","title":"Bad Request","status":400,"detail":"csv header has no \"title\" column for title","instance":"/expenses/import","code":"BAD_REQUEST"}`,
+		},
+		{
+			name:           "TestImportFormEncoded",
+			contentType:    echo.MIMEApplicationForm,
+			body:           "title,amount\ncoffee,65\n",
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `{"dry_run":false,"rows":1,"imported":1,"errors":[]}`,
+			expectedStored: 1,
+		},
+		{
+			name:           "TestImportMultipart",
+			contentType:    uploadType,
+			body:           uploaded,
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `{"dry_run":false,"rows":1,"imported":1,"errors":[]}`,
+			expectedStored: 1,
+		},
+		{
+			name:           "TestImportMultipartWithoutFile",
+			contentType:    misnamedType,
+			body:           misnamed,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "TestImportTooManyRows",
+			body:           "title,amount\n" + strings.Repeat("coffee,65\n", MaxImportRows+1),
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "TestImportTooLarge",
+			body:           "title,amount,note\ncoffee,65," + strings.Repeat("x", MaxImportBytes) + "\n",
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "TestImportBadMapping",
+			query:          "map=price:Total",
+			body:           "title,amount\n",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			h := ExpenseHandler(s)
+			e := echo.New()
+
+			req := httptest.NewRequest(http.MethodPost, "/expenses/import?"+test.query, strings.NewReader(test.body))
+			req.Header.Set(echo.HeaderContentType, "text/csv")
+			if test.contentType != "" {
+				req.Header.Set(echo.HeaderContentType, test.contentType)
+			}
+			rec := httptest.NewRecorder()
+			err := serve(newContext(e, req, rec), h.ImportCSVHandler)
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expectedStatus, rec.Code)
+				if test.expectedBody != "" {
+					assert.Equal(t, test.expectedBody, strings.TrimSpace(rec.Body.String()))
+				}
+				n, _ := s.Count(context.Background(), ListQuery{Scope: Scope{Owner: "user-1"}})
+				assert.Equal(t, test.expectedStored, n)
+			}
+		})
+	}
+}
+
+func TestUpdateIfMatch(t *testing.T) {
+	h := ExpenseHandler(seedMemoryStore(t))
+	e := echo.New()
+
+	do := func(method, id, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/expenses/"+id, strings.NewReader(expenseJson))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		c := newContext(e, req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+		if method == http.MethodGet {
+			serve(c, h.GetExpenseByIdHandler)
+		} else {
+			serve(c, h.UpdateExpenseHandler)
+		}
+		return rec
+	}
+
+	rec := do(http.MethodGet, "1", "")
+	assert.Equal(t, `"1"`, rec.Header().Get("ETag"))
+
+	rec = do(http.MethodPut, "1", `"1"`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"2"`, rec.Header().Get("ETag"))
+
+	rec = do(http.MethodPut, "1", `"1"`)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	rec = do(http.MethodPut, "1", `W/"2"`)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	rec = do(http.MethodPut, "1", "*")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"3"`, rec.Header().Get("ETag"))
+
+	rec = do(http.MethodPut, "1", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodPut, "99", `"1"`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPatchExpense(t *testing.T) {
+	tests := []struct {
+		name           string
+		contentType    string
+		ifMatch        string
+		body           string
+		expectedStatus int
+		expected       Expense
+	}{
+		{
+			name:           "TestMergePatchNote",
+			contentType:    MIMEMergePatch,
+			body:           `{"note": "x"}`,
+			expectedStatus: http.StatusOK,
+			expected:       Expense{Title: "strawberry smoothie", Amount: 79 * Baht, Note: "x", Tags: []string{"food", "beverage"}, Version: 2},
+		},
+		{
+			name:           "TestMergePatchRemoveTags",
+			contentType:    echo.MIMEApplicationJSON,
+			body:           `{"tags": null, "amount": 79.50}`,
+			expectedStatus: http.StatusOK,
+			expected:       Expense{Title: "strawberry smoothie", Amount: 7950 * Satang, Note: "night market promotion discount 10 bath", Version: 2},
+		},
+		{
+			name:           "TestMergePatchUnchanged",
+			contentType:    MIMEMergePatch,
+			body:           `{"title": "strawberry smoothie"}`,
+			expectedStatus: http.StatusOK,
+			expected:       Expense{Title: "strawberry smoothie", Amount: 79 * Baht, Note: "night market promotion discount 10 bath", Tags: []string{"food", "beverage"}, Version: 1},
+		},
+		{
+			name:           "TestJSONPatch",
+			contentType:    MIMEJSONPatch,
+			ifMatch:        `"1"`,
+			body:           `[{"op": "test", "path": "/tags/0", "value": "food"}, {"op": "remove", "path": "/tags/0"}, {"op": "add", "path": "/tags/-", "value": "drink"}, {"op": "copy", "from": "/title", "path": "/note"}]`,
+			expectedStatus: http.StatusOK,
+			expected:       Expense{Title: "strawberry smoothie", Amount: 79 * Baht, Note: "strawberry smoothie", Tags: []string{"beverage", "drink"}, Version: 2},
+		},
+		{
+			name:           "TestJSONPatchTestFailed",
+			contentType:    MIMEJSONPatch,
+			body:           `[{"op": "test", "path": "/title", "value": "apple"}, {"op": "replace", "path": "/title", "value": "x"}]`,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "TestJSONPatchTestNumberByValue",
+			contentType:    MIMEJSONPatch,
+			body:           `[{"op": "test", "path": "/amount", "value": 79.00}, {"op": "test", "path": "/tags", "value": ["food", "beverage"]}, {"op": "replace", "path": "/amount", "value": 79.50}, {"op": "test", "path": "/amount", "value": 79.5}]`,
+			expectedStatus: http.StatusOK,
+			expected:       Expense{Title: "strawberry smoothie", Amount: 79*Baht + 50*Satang, Note: "night market promotion discount 10 bath", Tags: []string{"food", "beverage"}, Version: 2},
+		},
+		{
+			name:           "TestJSONPatchTestNumberMismatch",
+			contentType:    MIMEJSONPatch,
+			body:           `[{"op": "test", "path": "/amount", "value": 79.01}, {"op": "replace", "path": "/amount", "value": 1}]`,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "TestJSONPatchMissingPath",
+			contentType:    MIMEJSONPatch,
+			body:           `[{"op": "replace", "path": "/tags/5", "value": "x"}]`,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "TestJSONPatchUnknownOp",
+			contentType:    MIMEJSONPatch,
+			body:           `[{"op": "merge", "path": "/title"}]`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "TestPatchUnknownField",
+			contentType:    MIMEMergePatch,
+			body:           `{"owner_id": "user-2"}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "TestPatchNegativeAmount",
+			contentType:    MIMEMergePatch,
+			body:           `{"amount": -1}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "TestPatchRemoveAmount",
+			contentType:    MIMEMergePatch,
+			body:           `{"amount": null}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "TestPatchNormalizesTags",
+			contentType:    MIMEMergePatch,
+			body:           `{"tags": ["Food", "food ", " Drink"]}`,
+			expectedStatus: http.StatusOK,
+			expected:       Expense{Title: "strawberry smoothie", Amount: 79 * Baht, Note: "night market promotion discount 10 bath", Tags: []string{"food", "drink"}, Version: 2},
+		},
+		{
+			name:           "TestPatchBlankTitle",
+			contentType:    MIMEJSONPatch,
+			body:           `[{"op": "replace", "path": "/title", "value": ""}]`,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "TestPatchStaleVersion",
+			contentType:    MIMEMergePatch,
+			ifMatch:        `"2"`,
+			body:           `{"note": "x"}`,
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "TestPatchUnsupportedMediaType",
+			contentType:    echo.MIMETextPlain,
+			body:           `note=x`,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := seedMemoryStore(t)
+			h := ExpenseHandler(s)
+			req := httptest.NewRequest(http.MethodPatch, "/expenses/1", strings.NewReader(test.body))
+			req.Header.Set(echo.HeaderContentType, test.contentType)
+			if test.ifMatch != "" {
+				req.Header.Set("If-Match", test.ifMatch)
+			}
+			rec := httptest.NewRecorder()
+			c := newContext(echo.New(), req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues("1")
+
+			if assert.NoError(t, serve(c, h.PatchExpenseHandler)) {
+				assert.Equal(t, test.expectedStatus, rec.Code, rec.Body.String())
+				stored, _ := s.Get(context.Background(), Scope{Owner: "user-1"}, 1)
+				if test.expectedStatus != http.StatusOK {
+					assert.Equal(t, 1, stored.Version)
+					return
+				}
+				assert.Equal(t, stored.ETag(), rec.Header().Get("ETag"))
+				assert.Equal(t, test.expected.Title, stored.Title)
+				assert.Equal(t, test.expected.Amount, stored.Amount)
+				assert.Equal(t, test.expected.Note, stored.Note)
+				assert.Equal(t, test.expected.Tags, stored.Tags)
+				assert.Equal(t, test.expected.Version, stored.Version)
+			}
+		})
+	}
+}
+
+func TestCreateIdempotencyKey(t *testing.T) {
+	s := NewMemoryStore()
+	h := ExpenseHandler(s)
+	e := echo.New()
+
+	do := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/expenses", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, serve(newContext(e, req, rec), h.CreateExpenseHandler))
+		return rec
+	}
+
+	first := do("key-1", expenseJson)
+	assert.Equal(t, http.StatusCreated, first.Code)
+
+	replay := do("key-1", `{"tags": ["food", "beverage"], "amount": 79, "note": "night market promotion discount 10 bath", "title": "strawberry smoothie"}`)
+	assert.Equal(t, http.StatusCreated, replay.Code)
+	assert.Equal(t, "true", replay.Header().Get("Idempotent-Replayed"))
+	assert.JSONEq(t, first.Body.String(), replay.Body.String())
+
+	rec := do("key-1", `{"title": "apple smoothie", "amount": 89}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = do("key-2", expenseBadRequestJson)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do("key-2", expenseJson)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = do(strings.Repeat("k", MaxIdempotencyKeyLength+1), expenseJson)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	n, _ := s.Count(context.Background(), ListQuery{Scope: Scope{Owner: "user-1"}})
+	assert.Equal(t, 2, n)
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	s := NewMemoryIdempotencyStore()
+
+	stored, err := s.Reserve(context.Background(), "user-1", "key", "hash", time.Hour)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	stored, _ = s.Reserve(context.Background(), "user-1", "key", "hash", time.Hour)
+	if assert.NotNil(t, stored) {
+		assert.Equal(t, 0, stored.Status)
+	}
+
+	stored, _ = s.Reserve(context.Background(), "user-2", "key", "hash", time.Hour)
+	assert.Nil(t, stored, "keys are per owner")
+
+	s.Complete(context.Background(), "user-1", "key", http.StatusCreated, []byte("{}"), time.Hour)
+	stored, _ = s.Reserve(context.Background(), "user-1", "key", "other", time.Hour)
+	if assert.NotNil(t, stored) {
+		assert.Equal(t, "hash", stored.Hash)
+		assert.Equal(t, http.StatusCreated, stored.Status)
+		assert.Equal(t, []byte("{}"), stored.Body)
+	}
+
+	stored, _ = s.Reserve(context.Background(), "user-3", "key", "hash", -time.Second)
+	assert.Nil(t, stored)
+	stored, _ = s.Reserve(context.Background(), "user-3", "key", "hash", time.Hour)
+	assert.Nil(t, stored, "expired keys are free again")
+
+	// A lease that runs out frees the key of a request that never completed,
+	// while a completed response is kept for its full ttl.
+	s.Reserve(context.Background(), "user-4", "crashed", "hash", -time.Second)
+	stored, _ = s.Reserve(context.Background(), "user-4", "crashed", "hash", time.Hour)
+	assert.Nil(t, stored, "an abandoned lease expires")
+
+	s.Reserve(context.Background(), "user-4", "done", "hash", -time.Second)
+	s.Complete(context.Background(), "user-4", "done", http.StatusCreated, []byte("{}"), time.Hour)
+	stored, _ = s.Reserve(context.Background(), "user-4", "done", "hash", time.Hour)
+	assert.NotNil(t, stored, "completing extends the lease to the ttl")
+}
+
+func TestBatchExpenses(t *testing.T) {
+	tests := []struct {
+		name             string
+		body             string
+		expectedStatus   int
+		expectedStatuses []int
+		expectedStored   int
+	}{
+		{
+			name: "TestBatchAtomic",
+			body: `{"operations": [
+				{"op": "create", "expense": {"title": "mango smoothie", "amount": 69}},
+				{"op": "update", "id": 2, "version": 1, "expense": {"title": "iPhone", "amount": 1}},
+				{"op": "delete", "id": 3}
+			]}`,
+			expectedStatus:   http.StatusOK,
+			expectedStatuses: []int{http.StatusCreated, http.StatusOK, http.StatusNoContent},
+			expectedStored:   3,
+		},
+		{
+			name: "TestBatchAtomicRollback",
+			body: `{"mode": "atomic", "operations": [
+				{"op": "create", "expense": {"title": "mango smoothie", "amount": 69}},
+				{"op": "create", "expense": {"title": "kiwi smoothie", "amount": 59}},
+				{"op": "delete", "id": 99}
+			]}`,
+			expectedStatus:   http.StatusUnprocessableEntity,
+			expectedStatuses: []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound},
+			expectedStored:   3,
+		},
+		{
+			name: "TestBatchAtomicInvalidOp",
+			body: `{"operations": [
+				{"op": "delete", "id": 3},
+				{"op": "upsert", "id": 1}
+			]}`,
+			expectedStatus:   http.StatusUnprocessableEntity,
+			expectedStatuses: []int{http.StatusFailedDependency, http.StatusBadRequest},
+			expectedStored:   3,
+		},
+		{
+			name: "TestBatchPartial",
+			body: `{"mode": "partial", "operations": [
+				{"op": "create", "expense": {"title": "mango smoothie", "amount": 69}},
+				{"op": "update", "id": 2, "version": 5, "expense": {"title": "iPhone", "amount": 1}},
+				{"op": "delete", "id": 3},
+				{"op": "delete"}
+			]}`,
+			expectedStatus:   http.StatusMultiStatus,
+			expectedStatuses: []int{http.StatusCreated, http.StatusPreconditionFailed, http.StatusNoContent, http.StatusBadRequest},
+			expectedStored:   3,
+		},
+		{
+			name:           "TestBatchUnknownMode",
+			body:           `{"mode": "some", "operations": [{"op": "delete", "id": 3}]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedStored: 3,
+		},
+		{
+			name:           "TestBatchEmpty",
+			body:           `{"operations": []}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedStored: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := seedMemoryStore(t)
+			h := ExpenseHandler(s)
+			e := echo.New()
+			e.HTTPErrorHandler = apierror.HTTPErrorHandler
+			e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+				return func(c echo.Context) error {
+					c.Set(auth.ContextKey, testPrincipal)
+					return next(c)
+				}
+			})
+			e.POST("/expenses\\:batch", h.BatchExpensesHandler)
+
+			req := httptest.NewRequest(http.MethodPost, "/expenses:batch", strings.NewReader(test.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expectedStatus, rec.Code, rec.Body.String())
+			if test.expectedStatuses != nil {
+				res := BatchResponse{}
+				if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) {
+					statuses := []int{}
+					for _, r := range res.Results {
+						statuses = append(statuses, r.Status)
+					}
+					assert.Equal(t, test.expectedStatuses, statuses)
+				}
+			}
+			n, _ := s.Count(context.Background(), ListQuery{Scope: Scope{Owner: "user-1"}})
+			assert.Equal(t, test.expectedStored, n)
+		})
+	}
+}
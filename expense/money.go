@@ -0,0 +1,132 @@
+package expense
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount of Thai baht counted in satang, the minor unit.
+// It is stored as NUMERIC(14,2) and encoded in JSON as a plain number such as
+// 79 or 79.5.
+type Money int64
+
+const (
+	Satang Money = 1
+	Baht         = 100 * Satang
+)
+
+// MoneyError reports an amount that can't be represented as Money.
+type MoneyError struct {
+	Value  string
+	Reason string
+}
+
+func (e *MoneyError) Error() string {
+	return fmt.Sprintf("amount %s %s", e.Value, e.Reason)
+}
+
+// ParseMoney parses a non-negative decimal with at most two fractional digits.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "-") {
+		return 0, &MoneyError{Value: s, Reason: "should not be negative"}
+	}
+	return parseDecimal(s)
+}
+
+func parseDecimal(s string) (Money, error) {
+	neg := strings.HasPrefix(s, "-")
+	whole, frac, _ := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if whole == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, &MoneyError{Value: s, Reason: "should be a decimal number"}
+	}
+
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > 2 {
+		return 0, &MoneyError{Value: s, Reason: "should have at most 2 decimal places"}
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > 999999999999 {
+		return 0, &MoneyError{Value: s, Reason: "is too large"}
+	}
+	cents, _ := strconv.ParseInt(frac, 10, 64)
+
+	m := Money(units)*Baht + Money(cents)
+	if neg {
+		m = -m
+	}
+	return m, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats m with exactly two decimal places, e.g. "79.50".
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, m/Baht, m%Baht)
+}
+
+// Float returns m in baht. It is only meant for reporting, where exactness
+// doesn't matter.
+func (m Money) Float() float64 {
+	return float64(m) / float64(Baht)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	s := strings.TrimSuffix(strings.TrimRight(m.String(), "0"), ".")
+	return []byte(s), nil
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+func (m *Money) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		*m = Money(v) * Baht
+		return nil
+	case float64:
+		*m = Money(math.Round(v * float64(Baht)))
+		return nil
+	default:
+		return fmt.Errorf("can't scan %T into Money", src)
+	}
+
+	v, err := parseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
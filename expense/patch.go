@@ -0,0 +1,469 @@
+package expense
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/apierror"
+)
+
+const (
+	MIMEMergePatch = "application/merge-patch+json"
+	MIMEJSONPatch  = "application/json-patch+json"
+)
+
+// PatchError is a patch that can't be applied. Status is the response code:
+// 400 for a malformed patch, 409 for a failed test op and 422 for a patch
+// that would leave the expense invalid.
+type PatchError struct {
+	Status  int
+	Message string
+}
+
+func (e *PatchError) Error() string {
+	return e.Message
+}
+
+func patchErr(status int, format string, a ...interface{}) *PatchError {
+	return &PatchError{Status: status, Message: fmt.Sprintf(format, a...)}
+}
+
+// PatchFunc edits exp in place and returns the names of the columns it changed.
+type PatchFunc func(exp *Expense) ([]string, error)
+
+// patchDoc is the part of an expense a patch can see and change.
+type patchDoc struct {
+	Title   string    `json:"title"`
+	Amount  Money     `json:"amount"`
+	Note    string    `json:"note"`
+	Tags    []string  `json:"tags"`
+	SpentAt time.Time `json:"spent_at"`
+}
+
+func (h *handler) PatchExpenseHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	rowId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apierror.BadRequest("id should be int")
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return apierror.BadRequest("can't read request body").Wrap(err)
+	}
+
+	var apply func(doc map[string]interface{}) (map[string]interface{}, error)
+	switch mime, _, _ := strings.Cut(c.Request().Header.Get(echo.HeaderContentType), ";"); strings.TrimSpace(mime) {
+	case MIMEJSONPatch:
+		ops, err := parseJSONPatch(body)
+		if err != nil {
+			return apierror.BadRequest(err.Error())
+		}
+		apply = ops.apply
+	case MIMEMergePatch, echo.MIMEApplicationJSON:
+		patch, err := decodeJSON(body)
+		if err != nil {
+			return apierror.BadRequest("invalid merge patch: " + err.Error())
+		}
+		obj, ok := patch.(map[string]interface{})
+		if !ok {
+			return apierror.BadRequest("merge patch should be a JSON object")
+		}
+		apply = func(doc map[string]interface{}) (map[string]interface{}, error) {
+			return mergePatch(doc, obj), nil
+		}
+	default:
+		return apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType, "content type should be "+MIMEMergePatch+" or "+MIMEJSONPatch)
+	}
+
+	version := parseIfMatch(c.Request().Header.Get("If-Match"))
+	exp, err := h.Store.Patch(c.Request().Context(), scope, rowId, version, patchWith(apply))
+	if err != nil {
+		var perr *PatchError
+		var verr *ValidationError
+		switch {
+		case errors.As(err, &verr):
+			return invalid(verr)
+		case errors.As(err, &perr):
+			return apierror.New(perr.Status, apierror.CodeFor(perr.Status), perr.Message)
+		}
+		return storeErr(c.Request().Context(), err)
+	}
+
+	c.Response().Header().Set("ETag", exp.ETag())
+	return c.JSON(http.StatusOK, exp)
+}
+
+// patchWith turns a patch on the generic JSON document of an expense into a
+// PatchFunc that reports the changed columns.
+func patchWith(apply func(doc map[string]interface{}) (map[string]interface{}, error)) PatchFunc {
+	return func(exp *Expense) ([]string, error) {
+		old := patchDoc{Title: exp.Title, Amount: exp.Amount, Note: exp.Note, Tags: exp.Tags, SpentAt: exp.SpentAt}
+		if old.Tags == nil {
+			old.Tags = []string{}
+		}
+		b, _ := json.Marshal(old)
+		doc, _ := decodeJSON(b)
+
+		patched, err := apply(doc.(map[string]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := patched["amount"]; !ok {
+			return nil, patchErr(http.StatusUnprocessableEntity, "amount can't be removed")
+		}
+		if _, ok := patched["spent_at"]; !ok {
+			return nil, patchErr(http.StatusUnprocessableEntity, "spent_at can't be removed")
+		}
+
+		b, _ = json.Marshal(patched)
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		doc2 := patchDoc{}
+		if err := dec.Decode(&doc2); err != nil {
+			return nil, patchErr(http.StatusUnprocessableEntity, "patched expense is invalid: %s", err)
+		}
+		patchedExp := Expense{Title: doc2.Title, Amount: doc2.Amount, Note: doc2.Note, Tags: doc2.Tags, SpentAt: doc2.SpentAt}
+		if verr := patchedExp.Validate(); verr != nil {
+			return nil, verr
+		}
+
+		changed := []string{}
+		if patchedExp.Title != old.Title {
+			exp.Title = patchedExp.Title
+			changed = append(changed, "title")
+		}
+		if patchedExp.Amount != old.Amount {
+			exp.Amount = patchedExp.Amount
+			changed = append(changed, "amount")
+		}
+		if patchedExp.Note != old.Note {
+			exp.Note = patchedExp.Note
+			changed = append(changed, "note")
+		}
+		if !equalTags(patchedExp.Tags, old.Tags) {
+			exp.Tags = patchedExp.Tags
+			changed = append(changed, "tags")
+		}
+		if !patchedExp.SpentAt.Equal(old.SpentAt) {
+			exp.SpentAt = patchedExp.SpentAt
+			changed = append(changed, "spent_at")
+		}
+		return changed, nil
+	}
+}
+
+func equalTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeJSON keeps numbers as json.Number so amounts stay exact.
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch.
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	for k, v := range patch {
+		if v == nil {
+			delete(target, k)
+			continue
+		}
+		if obj, ok := v.(map[string]interface{}); ok {
+			t, _ := target[k].(map[string]interface{})
+			if t == nil {
+				t = map[string]interface{}{}
+			}
+			target[k] = mergePatch(t, obj)
+			continue
+		}
+		target[k] = v
+	}
+	return target
+}
+
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+
+	hasValue bool
+}
+
+type jsonPatch []jsonPatchOp
+
+// parseJSONPatch reads an RFC 6902 JSON Patch document.
+func parseJSONPatch(b []byte) (jsonPatch, error) {
+	v, err := decodeJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid json patch: %w", err)
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("json patch should be an array of operations")
+	}
+
+	ops := jsonPatch{}
+	for i, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operation %d should be an object", i)
+		}
+		op := jsonPatchOp{}
+		op.Op, _ = obj["op"].(string)
+		op.Path, ok = obj["path"].(string)
+		if !ok {
+			return nil, fmt.Errorf("operation %d has no path", i)
+		}
+		op.From, _ = obj["from"].(string)
+		op.Value, op.hasValue = obj["value"]
+
+		switch op.Op {
+		case "add", "replace", "test":
+			if !op.hasValue {
+				return nil, fmt.Errorf("operation %d (%s) has no value", i, op.Op)
+			}
+		case "move", "copy":
+			if _, ok := obj["from"]; !ok {
+				return nil, fmt.Errorf("operation %d (%s) has no from", i, op.Op)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d has unknown op %q", i, op.Op)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (ops jsonPatch) apply(doc map[string]interface{}) (map[string]interface{}, error) {
+	var root interface{} = doc
+	for i, op := range ops {
+		path, err := pointer(op.Path)
+		if err != nil {
+			return nil, patchErr(http.StatusBadRequest, "operation %d: %s", i, err)
+		}
+
+		switch op.Op {
+		case "add":
+			root, err = addAt(root, path, op.Value)
+		case "remove":
+			root, _, err = removeAt(root, path)
+		case "replace":
+			if root, _, err = removeAt(root, path); err == nil {
+				root, err = addAt(root, path, op.Value)
+			}
+		case "move", "copy":
+			var from []string
+			var v interface{}
+			if from, err = pointer(op.From); err != nil {
+				break
+			}
+			if op.Op == "move" {
+				root, v, err = removeAt(root, from)
+			} else {
+				v, err = getAt(root, from)
+			}
+			if err == nil {
+				root, err = addAt(root, path, v)
+			}
+		case "test":
+			var v interface{}
+			if v, err = getAt(root, path); err == nil && !jsonEqual(v, op.Value) {
+				return nil, patchErr(http.StatusConflict, "operation %d: test failed at %s", i, op.Path)
+			}
+		}
+		if err != nil {
+			return nil, patchErr(http.StatusUnprocessableEntity, "operation %d (%s %s): %s", i, op.Op, op.Path, err)
+		}
+	}
+	return root.(map[string]interface{}), nil
+}
+
+// pointer splits an RFC 6901 JSON pointer. The document root can't be the
+// target of an operation.
+func pointer(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("path %q should start with /", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func index(arr []interface{}, tok string, allowEnd bool) (int, error) {
+	if tok == "-" && allowEnd {
+		return len(arr), nil
+	}
+	i, err := strconv.Atoi(tok)
+	max := len(arr) - 1
+	if allowEnd {
+		max = len(arr)
+	}
+	if err != nil || i < 0 || i > max || (tok != "0" && strings.HasPrefix(tok, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", tok)
+	}
+	return i, nil
+}
+
+func getAt(node interface{}, path []string) (interface{}, error) {
+	for _, tok := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[tok]
+			if !ok {
+				return nil, fmt.Errorf("%q does not exist", tok)
+			}
+			node = v
+		case []interface{}:
+			i, err := index(n, tok, false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("%q does not exist", tok)
+		}
+	}
+	return node, nil
+}
+
+func addAt(node interface{}, path []string, v interface{}) (interface{}, error) {
+	tok := path[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			n[tok] = v
+			return n, nil
+		}
+		child, ok := n[tok]
+		if !ok {
+			return nil, fmt.Errorf("%q does not exist", tok)
+		}
+		child, err := addAt(child, path[1:], v)
+		n[tok] = child
+		return n, err
+	case []interface{}:
+		if len(path) == 1 {
+			i, err := index(n, tok, true)
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = v
+			return n, nil
+		}
+		i, err := index(n, tok, false)
+		if err != nil {
+			return nil, err
+		}
+		n[i], err = addAt(n[i], path[1:], v)
+		return n, err
+	}
+	return nil, fmt.Errorf("%q does not exist", tok)
+}
+
+func removeAt(node interface{}, path []string) (interface{}, interface{}, error) {
+	tok := path[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[tok]
+		if !ok {
+			return nil, nil, fmt.Errorf("%q does not exist", tok)
+		}
+		if len(path) == 1 {
+			delete(n, tok)
+			return n, child, nil
+		}
+		child, removed, err := removeAt(child, path[1:])
+		n[tok] = child
+		return n, removed, err
+	case []interface{}:
+		i, err := index(n, tok, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := n[i]
+			return append(n[:i], n[i+1:]...), removed, nil
+		}
+		child, removed, err := removeAt(n[i], path[1:])
+		n[i] = child
+		return n, removed, err
+	}
+	return nil, nil, fmt.Errorf("%q does not exist", tok)
+}
+
+// jsonEqual compares two decoded JSON values as RFC 6902 section 4.6 asks for
+// the test operation: numbers by value, so 79.50 equals 79.5, objects
+// regardless of key order and arrays element by element.
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		m, okm := new(big.Rat).SetString(x.String())
+		n, okn := new(big.Rat).SetString(y.String())
+		return okm && okn && m.Cmp(n) == 0
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,745 @@
+package expense
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/teerit/assessment/tracing"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ ExpenseStore = (*postgresStore)(nil)
+
+// expenseColumns is the column list every query scans with scanExpense.
+const expenseColumns = "id, title, amount, note, tags, owner_id, spent_at, created_at, updated_at, version"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanExpense reads expenseColumns followed by any extra columns.
+func scanExpense(row scanner, exp *Expense, extra ...interface{}) error {
+	dest := append([]interface{}{
+		&exp.Id, &exp.Title, &exp.Amount, &exp.Note, pq.Array(&exp.Tags),
+		&exp.OwnerId, &exp.SpentAt, &exp.CreatedAt, &exp.UpdatedAt, &exp.Version,
+	}, extra...)
+	return row.Scan(dest...)
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// traced runs statements on a querier in spans of their own. The span of a
+// query ends once the query returns, before its rows are read. With a
+// statement cache, statements run prepared, within tx when it is set.
+type traced struct {
+	q     querier
+	stmts *stmtCache
+	tx    *sql.Tx
+}
+
+func (t traced) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startSpan(ctx, query)
+	var res sql.Result
+	var err error
+	stmt, release := t.stmt(ctx, query)
+	if stmt != nil {
+		res, err = stmt.ExecContext(ctx, args...)
+	} else {
+		res, err = t.q.ExecContext(ctx, query, args...)
+	}
+	release()
+	err = interrupted(ctx, err)
+	endSpan(span, err)
+	return res, err
+}
+
+func (t traced) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startSpan(ctx, query)
+	var rows *sql.Rows
+	var err error
+	stmt, release := t.stmt(ctx, query)
+	if stmt != nil {
+		rows, err = stmt.QueryContext(ctx, args...)
+	} else {
+		rows, err = t.q.QueryContext(ctx, query, args...)
+	}
+	release()
+	err = interrupted(ctx, err)
+	endSpan(span, err)
+	return rows, err
+}
+
+func (t traced) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := startSpan(ctx, query)
+	var row *sql.Row
+	stmt, release := t.stmt(ctx, query)
+	if stmt != nil {
+		row = stmt.QueryRowContext(ctx, args...)
+	} else {
+		row = t.q.QueryRowContext(ctx, query, args...)
+	}
+	release()
+	endSpan(span, row.Err())
+	return row
+}
+
+// stmt returns the cached statement of query, or nil to run query as is,
+// and the func to call once the statement has run.
+func (t traced) stmt(ctx context.Context, query string) (*sql.Stmt, func()) {
+	if t.stmts == nil {
+		return nil, noRelease
+	}
+	if t.tx == nil {
+		return t.stmts.get(ctx, query)
+	}
+	// Only statements prepared already are used in a transaction, as its own
+	// copy, which is prepared on its connection and closed along with it.
+	stmt, release := t.stmts.cached(query)
+	if stmt != nil {
+		stmt = t.tx.StmtContext(ctx, stmt)
+	}
+	return stmt, release
+}
+
+// interrupted attributes err to ctx once ctx is done, whatever error the
+// driver reported for the statement it had to abandon.
+func interrupted(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	return err
+}
+
+// startSpan starts the client span of one statement. Values are always passed
+// as parameters, so the statement text is safe to export.
+func startSpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	op := query
+	if fields := strings.Fields(query); len(fields) > 0 {
+		op = strings.ToUpper(fields[0])
+	}
+	return tracing.Tracer().Start(ctx, op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemPostgreSQL,
+		semconv.DBOperation(op),
+		semconv.DBStatement(query),
+	))
+}
+
+// endSpan ends span, marking it failed unless err is nil or sql.ErrNoRows.
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// DefaultStatementTimeout bounds each store call, including every statement
+// of its transaction.
+const DefaultStatementTimeout = 5 * time.Second
+
+// queryCanceled is the postgres error code of a statement canceled on request
+// or by statement_timeout.
+const queryCanceled = "57014"
+
+// isTimeout reports whether err comes from a statement that ran out of time.
+func isTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &pqErr) && pqErr.Code == queryCanceled)
+}
+
+// withTimeout bounds a store call by timeout as well as by ctx. A zero timeout
+// leaves ctx as is.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+type postgresStore struct {
+	DB *sql.DB
+	// Timeout bounds every store call on top of the caller's context.
+	Timeout time.Duration
+	stmts   *stmtCache
+}
+
+// NewPostgresStore returns an ExpenseStore backed by the expenses table.
+// Statements are prepared on first use; Prepare prepares the common ones up
+// front.
+func NewPostgresStore(db *sql.DB) *postgresStore {
+	return &postgresStore{DB: db, Timeout: DefaultStatementTimeout, stmts: newStmtCache(db)}
+}
+
+// db runs statements outside of a transaction.
+func (s *postgresStore) db() querier {
+	return traced{q: s.DB, stmts: s.stmts}
+}
+
+// inTx runs statements within tx.
+func (s *postgresStore) inTx(tx *sql.Tx) querier {
+	return traced{q: tx, stmts: s.stmts, tx: tx}
+}
+
+// Prepare prepares the statements of every single-expense operation, of the
+// unfiltered list and of search, for one owner and for all, so that the first
+// requests after startup don't pay for planning them. The schema must be up
+// to date.
+func (s *postgresStore) Prepare(ctx context.Context) error {
+	queries := []string{createSQL}
+	for _, scope := range []Scope{{Owner: "-"}, {All: true}} {
+		get, _ := getSQL(scope, 0)
+		lock, _ := lockSQL(scope, 0)
+		update, _ := updateSQL(scope, &Expense{})
+		updateVersion, _ := updateSQL(scope, &Expense{Version: 1})
+		del, _ := deleteSQL(scope, 0)
+		trash, _ := trashSQL(scope)
+		restore, _ := restoreSQL(scope, 0)
+		purge, _ := purgeSQL(scope, time.Time{})
+		list, _ := ListQuery{Scope: scope, Sort: "id"}.SQL()
+		page, _ := ListQuery{Scope: scope, Sort: "id", Paginate: true}.SQL()
+		count, _ := countSQL(ListQuery{Scope: scope})
+		search, _ := SearchQuery{Scope: scope}.SQL()
+		queries = append(queries, get, lock, update, updateVersion, del, trash, restore, purge, list, page, count, search)
+	}
+
+	for _, query := range queries {
+		if _, err := s.stmts.prepare(ctx, query); err != nil {
+			return fmt.Errorf("preparing %q: %w", query, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the prepared statements. The store can still be used and
+// prepares them again as needed.
+func (s *postgresStore) Close() error {
+	return s.stmts.Close()
+}
+
+// nullTime lets a zero time fall back to the column default through COALESCE.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+const createSQL = "INSERT INTO expenses (title, amount, note, tags, owner_id, spent_at) values ($1, $2, $3, $4, $5, COALESCE($6, now())) RETURNING id, spent_at, created_at, updated_at, version"
+
+func (s *postgresStore) Create(ctx context.Context, exp *Expense) error {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	return createExpense(ctx, s.db(), exp)
+}
+
+func createExpense(ctx context.Context, q querier, exp *Expense) error {
+	row := q.QueryRowContext(ctx, createSQL, exp.Title, exp.Amount, exp.Note, pq.Array(exp.Tags), exp.OwnerId, nullTime(exp.SpentAt))
+	return row.Scan(&exp.Id, &exp.SpentAt, &exp.CreatedAt, &exp.UpdatedAt, &exp.Version)
+}
+
+func (s *postgresStore) CreateBatch(ctx context.Context, exps []*Expense) error {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertExpenses(ctx, s.inTx(tx), exps); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertBatchSize keeps a multi-row insert well below the 65535 parameters
+// Postgres allows in one statement.
+const insertBatchSize = 1000
+
+// insertExpenses stores exps with multi-row inserts and sets their Ids and
+// server-managed fields.
+func insertExpenses(ctx context.Context, q querier, exps []*Expense) error {
+	for len(exps) > 0 {
+		n := len(exps)
+		if n > insertBatchSize {
+			n = insertBatchSize
+		}
+		if err := insertChunk(ctx, q, exps[:n]); err != nil {
+			return err
+		}
+		exps = exps[n:]
+	}
+	return nil
+}
+
+// insertChunk inserts exps with one statement. Postgres promises neither the
+// order ids are drawn in nor the order of RETURNING rows, so each row carries
+// its index in exps and the returned rows are matched by it.
+func insertChunk(ctx context.Context, q querier, exps []*Expense) error {
+	values := make([]string, len(exps))
+	args := make([]interface{}, 0, 6*len(exps))
+	for i, exp := range exps {
+		n := len(args)
+		values[i] = fmt.Sprintf("(%d, $%d, $%d::numeric, $%d, $%d::text[], $%d, $%d::timestamptz)", i, n+1, n+2, n+3, n+4, n+5, n+6)
+		args = append(args, exp.Title, exp.Amount, exp.Note, pq.Array(exp.Tags), exp.OwnerId, nullTime(exp.SpentAt))
+	}
+
+	rows, err := q.QueryContext(ctx, `WITH v AS (
+		SELECT nextval(pg_get_serial_sequence('expenses', 'id')) AS id, * FROM (VALUES `+strings.Join(values, ", ")+`) AS r (ord, title, amount, note, tags, owner_id, spent_at)
+	), ins AS (
+		INSERT INTO expenses (id, title, amount, note, tags, owner_id, spent_at)
+		SELECT id, title, amount, note, tags, owner_id, COALESCE(spent_at, now()) FROM v
+		RETURNING id, spent_at, created_at, updated_at, version
+	)
+	SELECT v.ord, ins.id, ins.spent_at, ins.created_at, ins.updated_at, ins.version FROM ins JOIN v ON v.id = ins.id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	inserted := make([]bool, len(exps))
+	n := 0
+	for rows.Next() {
+		var ord int
+		exp := Expense{}
+		if err := rows.Scan(&ord, &exp.Id, &exp.SpentAt, &exp.CreatedAt, &exp.UpdatedAt, &exp.Version); err != nil {
+			return err
+		}
+		if ord < 0 || ord >= len(exps) || inserted[ord] {
+			return fmt.Errorf("insert returned unexpected row %d", ord)
+		}
+		inserted[ord] = true
+		n++
+		exps[ord].Id, exps[ord].SpentAt, exps[ord].CreatedAt, exps[ord].UpdatedAt, exps[ord].Version = exp.Id, exp.SpentAt, exp.CreatedAt, exp.UpdatedAt, exp.Version
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if n != len(exps) {
+		return fmt.Errorf("inserted %d of %d expenses", n, len(exps))
+	}
+	return nil
+}
+
+func (s *postgresStore) Get(ctx context.Context, scope Scope, id int) (Expense, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	return getExpense(ctx, s.db(), scope, id)
+}
+
+func getExpense(ctx context.Context, q querier, scope Scope, id int) (Expense, error) {
+	query, args := getSQL(scope, id)
+	row := q.QueryRowContext(ctx, query, args...)
+
+	exp := Expense{}
+	err := scanExpense(row, &exp)
+	if err == sql.ErrNoRows {
+		return exp, ErrNotFound
+	}
+	return exp, err
+}
+
+func getSQL(scope Scope, id int) (string, []interface{}) {
+	where, args := scope.cond("id=$1 AND deleted_at IS NULL", id)
+	return "SELECT " + expenseColumns + " FROM expenses WHERE " + where, args
+}
+
+func (s *postgresStore) List(ctx context.Context, q ListQuery) ([]Expense, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	stmt, args := q.SQL()
+	rows, err := s.db().QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exps := []Expense{}
+	for rows.Next() {
+		exp := Expense{}
+		if err := scanExpense(rows, &exp); err != nil {
+			return nil, err
+		}
+		exps = append(exps, exp)
+	}
+	return exps, rows.Err()
+}
+
+func (s *postgresStore) Count(ctx context.Context, q ListQuery) (int, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	query, args := countSQL(q)
+
+	var n int
+	err := s.db().QueryRowContext(ctx, query, args...).Scan(&n)
+	return n, err
+}
+
+func countSQL(q ListQuery) (string, []interface{}) {
+	where, args := q.Where()
+	return "SELECT count(*) FROM expenses WHERE " + where, args
+}
+
+func (s *postgresStore) Summary(ctx context.Context, q SummaryQuery) ([]SummaryRow, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	stmt, args := q.SQL()
+	rows, err := s.db().QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summary := []SummaryRow{}
+	for rows.Next() {
+		r := SummaryRow{}
+		dest := []interface{}{}
+		if q.GroupByTag {
+			dest = append(dest, &r.Tag)
+		}
+		var period time.Time
+		if q.Period != "" {
+			dest = append(dest, &period)
+		}
+		dest = append(dest, &r.Count, &r.Total, &r.Average, &r.Min, &r.Max)
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if q.Period != "" {
+			r.Period = period.Format("2006-01-02")
+		}
+		summary = append(summary, r)
+	}
+	return summary, rows.Err()
+}
+
+func (s *postgresStore) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	stmt, args := q.SQL()
+	rows, err := s.db().QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		r := SearchResult{}
+		if err := scanExpense(rows, &r.Expense, &r.Rank); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// Update replaces the client-editable fields and fills in the server-managed
+// ones. A zero SpentAt keeps the stored value.
+func (s *postgresStore) Update(ctx context.Context, scope Scope, exp *Expense) error {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	query, args := updateSQL(scope, exp)
+	row := s.db().QueryRowContext(ctx, query, args...)
+	return scanUpdated(ctx, s.db(), row, scope, exp)
+}
+
+func updateSQL(scope Scope, exp *Expense) (string, []interface{}) {
+	where, args := scope.cond("id=$1 AND deleted_at IS NULL", exp.Id, exp.Title, exp.Amount, exp.Note, pq.Array(exp.Tags), nullTime(exp.SpentAt))
+	if exp.Version != 0 {
+		args = append(args, exp.Version)
+		where += " AND version=$" + strconv.Itoa(len(args))
+	}
+	return `UPDATE expenses SET title=$2, amount=$3, note=$4, tags=$5, spent_at=COALESCE($6, spent_at), updated_at=now(), version=version+1 WHERE ` + where + ` RETURNING owner_id, spent_at, created_at, updated_at, version`, args
+}
+
+// scanUpdated reads the row returned by the updateSQL statement.
+func scanUpdated(ctx context.Context, q querier, row *sql.Row, scope Scope, exp *Expense) error {
+	err := row.Scan(&exp.OwnerId, &exp.SpentAt, &exp.CreatedAt, &exp.UpdatedAt, &exp.Version)
+	if err == sql.ErrNoRows && exp.Version != 0 {
+		// Tell a stale version apart from a missing row.
+		if _, err := getExpense(ctx, q, scope, exp.Id); err != nil {
+			return err
+		}
+		return ErrVersionMismatch
+	}
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// patchColumns maps the names a PatchFunc reports to the value to store.
+var patchColumns = map[string]func(exp *Expense) interface{}{
+	"title":    func(exp *Expense) interface{} { return exp.Title },
+	"amount":   func(exp *Expense) interface{} { return exp.Amount },
+	"note":     func(exp *Expense) interface{} { return exp.Note },
+	"tags":     func(exp *Expense) interface{} { return pq.Array(exp.Tags) },
+	"spent_at": func(exp *Expense) interface{} { return exp.SpentAt },
+}
+
+func (s *postgresStore) Patch(ctx context.Context, scope Scope, id int, version int, fn PatchFunc) (Expense, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	exp := Expense{}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return exp, err
+	}
+	defer tx.Rollback()
+	q := s.inTx(tx)
+
+	query, args := lockSQL(scope, id)
+	err = scanExpense(q.QueryRowContext(ctx, query, args...), &exp)
+	if err == sql.ErrNoRows {
+		return exp, ErrNotFound
+	}
+	if err != nil {
+		return exp, err
+	}
+	if version != 0 && version != exp.Version {
+		return exp, ErrVersionMismatch
+	}
+
+	changed, err := fn(&exp)
+	if err != nil {
+		return exp, err
+	}
+	if len(changed) == 0 {
+		return exp, tx.Commit()
+	}
+
+	sets := []string{}
+	args = []interface{}{exp.Id}
+	for _, col := range changed {
+		value, ok := patchColumns[col]
+		if !ok {
+			return exp, fmt.Errorf("column %q can't be patched", col)
+		}
+		args = append(args, value(&exp))
+		sets = append(sets, col+"=$"+strconv.Itoa(len(args)))
+	}
+	err = q.QueryRowContext(ctx, "UPDATE expenses SET "+strings.Join(sets, ", ")+", updated_at=now(), version=version+1 WHERE id=$1 RETURNING updated_at, version", args...).Scan(&exp.UpdatedAt, &exp.Version)
+	if err != nil {
+		return exp, err
+	}
+	return exp, tx.Commit()
+}
+
+func lockSQL(scope Scope, id int) (string, []interface{}) {
+	query, args := getSQL(scope, id)
+	return query + " FOR UPDATE", args
+}
+
+func (s *postgresStore) Delete(ctx context.Context, scope Scope, id int) error {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	return deleteExpense(ctx, s.db(), scope, id)
+}
+
+func deleteExpense(ctx context.Context, q querier, scope Scope, id int) error {
+	query, args := deleteSQL(scope, id)
+	res, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+func deleteSQL(scope Scope, id int) (string, []interface{}) {
+	where, args := scope.cond("id=$1 AND deleted_at IS NULL", id)
+	return "UPDATE expenses SET deleted_at=now() WHERE " + where, args
+}
+
+// Batch runs the operations in order. Consecutive creates are inserted
+// together with multi-row statements before the next update or delete runs,
+// so every operation sees the ones before it. In partial mode every
+// statement gets a savepoint so a failure only undoes it; a multi-row insert
+// that fails is retried row by row to find the rows at fault. In atomic mode
+// any failure undoes everything.
+func (s *postgresStore) Batch(ctx context.Context, scope Scope, ops []BatchOp, atomic bool) ([]error, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	q := s.inTx(tx)
+
+	run := func(fn func() error) error {
+		if atomic {
+			return fn()
+		}
+		return withSavepoint(ctx, q, fn)
+	}
+
+	errs := make([]error, len(ops))
+	creates, createdAt := []*Expense{}, []int{}
+	// flush inserts the creates collected since the last other operation.
+	flush := func() bool {
+		failed := false
+		for len(creates) > 0 {
+			n := len(creates)
+			if n > insertBatchSize {
+				n = insertBatchSize
+			}
+			chunk, at := creates[:n], createdAt[:n]
+			creates, createdAt = creates[n:], createdAt[n:]
+
+			err := run(func() error { return insertChunk(ctx, q, chunk) })
+			if err != nil && !atomic {
+				for j, exp := range chunk {
+					errs[at[j]] = run(func() error { return createExpense(ctx, q, exp) })
+					failed = failed || errs[at[j]] != nil
+				}
+				continue
+			}
+			for _, i := range at {
+				errs[i] = err
+			}
+			failed = failed || err != nil
+		}
+		return failed
+	}
+
+	for i, op := range ops {
+		if op.Op == BatchCreate {
+			creates, createdAt = append(creates, op.Expense), append(createdAt, i)
+			continue
+		}
+		if flush() && atomic {
+			return abortBatch(errs), nil
+		}
+
+		switch op.Op {
+		case BatchUpdate:
+			errs[i] = run(func() error {
+				query, args := updateSQL(scope, op.Expense)
+				return scanUpdated(ctx, q, q.QueryRowContext(ctx, query, args...), scope, op.Expense)
+			})
+		case BatchDelete:
+			errs[i] = run(func() error { return deleteExpense(ctx, q, scope, op.Id) })
+		default:
+			errs[i] = fmt.Errorf("unknown batch op %q", op.Op)
+		}
+		if errs[i] != nil && atomic {
+			return abortBatch(errs), nil
+		}
+	}
+	if flush() && atomic {
+		return abortBatch(errs), nil
+	}
+	return errs, tx.Commit()
+}
+
+func withSavepoint(ctx context.Context, q querier, fn func() error) error {
+	if _, err := q.ExecContext(ctx, "SAVEPOINT batch_op"); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if _, rerr := q.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_op"); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	_, err := q.ExecContext(ctx, "RELEASE SAVEPOINT batch_op")
+	return err
+}
+
+func (s *postgresStore) Trash(ctx context.Context, scope Scope) ([]Expense, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	query, args := trashSQL(scope)
+	rows, err := s.db().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exps := []Expense{}
+	for rows.Next() {
+		exp := Expense{}
+		if err := scanExpense(rows, &exp, &exp.DeletedAt); err != nil {
+			return nil, err
+		}
+		exps = append(exps, exp)
+	}
+	return exps, rows.Err()
+}
+
+func trashSQL(scope Scope) (string, []interface{}) {
+	where, args := scope.cond("deleted_at IS NOT NULL")
+	return "SELECT " + expenseColumns + ", deleted_at FROM expenses WHERE " + where + " ORDER BY deleted_at DESC", args
+}
+
+func (s *postgresStore) Restore(ctx context.Context, scope Scope, id int) (Expense, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	query, args := restoreSQL(scope, id)
+	row := s.db().QueryRowContext(ctx, query, args...)
+
+	exp := Expense{}
+	err := scanExpense(row, &exp)
+	if err == sql.ErrNoRows {
+		return exp, ErrNotFound
+	}
+	return exp, err
+}
+
+func restoreSQL(scope Scope, id int) (string, []interface{}) {
+	where, args := scope.cond("id=$1 AND deleted_at IS NOT NULL", id)
+	return "UPDATE expenses SET deleted_at=NULL WHERE " + where + " RETURNING " + expenseColumns, args
+}
+
+func (s *postgresStore) Purge(ctx context.Context, scope Scope, before time.Time) (int64, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	query, args := purgeSQL(scope, before)
+	res, err := s.db().ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func purgeSQL(scope Scope, before time.Time) (string, []interface{}) {
+	where, args := scope.cond("deleted_at IS NOT NULL AND deleted_at < $1", before)
+	return "DELETE FROM expenses WHERE " + where, args
+}
+
+func expectAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package expense
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
+)
+
+// sortColumns maps the values accepted by the sort query parameter to columns.
+var sortColumns = map[string]string{
+	"id":     "id",
+	"amount": "amount",
+	"title":  "title",
+}
+
+// Cursor marks the last row of a page: the value of the sort column and the id
+// used as a tie breaker. Sort is the sort parameter the cursor was issued for,
+// such as "-amount", since the value means nothing under another order.
+type Cursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	Id    int         `json:"id"`
+}
+
+func (cur Cursor) Encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	cur := &Cursor{}
+	if err := json.Unmarshal(b, cur); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return cur, nil
+}
+
+// ListQuery holds the pagination, sorting and filtering options of the list
+// endpoint.
+type ListQuery struct {
+	// Paginate is set when the client asked for a page (limit or cursor) and
+	// expects the ExpensePage envelope instead of a bare array.
+	Paginate  bool
+	Scope     Scope
+	Limit     int
+	Cursor    *Cursor
+	Sort      string
+	Desc      bool
+	Tags      []string
+	MinAmount *Money
+	MaxAmount *Money
+	// SpentFrom is inclusive and SpentTo exclusive.
+	SpentFrom *time.Time
+	SpentTo   *time.Time
+	Q         string
+	// Expr is the parsed filter parameter, if any.
+	Expr *FilterExpr
+}
+
+type ExpensePage struct {
+	Data       []Expense `json:"data"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	Total      int       `json:"total"`
+}
+
+func ParseListQuery(c echo.Context) (ListQuery, error) {
+	q := ListQuery{Sort: "id", Limit: DefaultPageLimit}
+
+	if s := c.QueryParam("sort"); s != "" {
+		q.Desc = strings.HasPrefix(s, "-")
+		q.Sort = strings.TrimPrefix(s, "-")
+		if _, ok := sortColumns[q.Sort]; !ok {
+			return q, fmt.Errorf("sort should be one of id, amount, title: %q", s)
+		}
+	}
+
+	if s := c.QueryParam("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxPageLimit {
+			return q, fmt.Errorf("limit should be int between 1 and %d", MaxPageLimit)
+		}
+		q.Paginate = true
+		q.Limit = limit
+	}
+
+	if s := c.QueryParam("cursor"); s != "" {
+		cur, err := DecodeCursor(s)
+		if err != nil {
+			return q, err
+		}
+		if cur.Sort != q.sortParam() {
+			return q, fmt.Errorf("cursor was issued for another sort, list again from the first page")
+		}
+		if _, err := cursorExpense(q.Sort, *cur); err != nil {
+			return q, err
+		}
+		q.Paginate = true
+		q.Cursor = cur
+	}
+
+	err := q.parseFilters(c, time.UTC)
+	return q, err
+}
+
+// parseFilters reads the filter parameters shared by the list and summary
+// endpoints. Plain dates in spent_from/spent_to are midnight in loc.
+func (q *ListQuery) parseFilters(c echo.Context, loc *time.Location) error {
+	for _, tag := range c.QueryParams()["tag"] {
+		if tag != "" {
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+
+	var err error
+	if q.MinAmount, err = parseAmountParam(c, "min_amount"); err != nil {
+		return err
+	}
+	if q.MaxAmount, err = parseAmountParam(c, "max_amount"); err != nil {
+		return err
+	}
+
+	if q.SpentFrom, err = parseTimeParam(c, "spent_from", loc); err != nil {
+		return err
+	}
+	if q.SpentTo, err = parseTimeParam(c, "spent_to", loc); err != nil {
+		return err
+	}
+
+	q.Q = strings.TrimSpace(c.QueryParam("q"))
+
+	if s := c.QueryParam("filter"); strings.TrimSpace(s) != "" {
+		if q.Expr, err = ParseFilter(s, loc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseAmountParam(c echo.Context, name string) (*Money, error) {
+	s := c.QueryParam(name)
+	if s == "" {
+		return nil, nil
+	}
+	v, err := ParseMoney(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &v, nil
+}
+
+// parseTimeParam accepts an RFC 3339 timestamp or a plain 2006-01-02 date,
+// which is taken as midnight in loc.
+func parseTimeParam(c echo.Context, name string, loc *time.Location) (*time.Time, error) {
+	s := c.QueryParam(name)
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.ParseInLocation("2006-01-02", s, loc); err != nil {
+			return nil, fmt.Errorf("%s should be RFC 3339 time or date", name)
+		}
+	}
+	return &t, nil
+}
+
+// Where builds the filter clause shared by the page and count queries. The
+// cursor is not part of it so the total covers every matching row.
+func (q ListQuery) Where() (string, []interface{}) {
+	conds := []string{"deleted_at IS NULL"}
+	args := []interface{}{}
+
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	for _, tag := range q.Tags {
+		conds = append(conds, arg(tag)+" = ANY(tags)")
+	}
+	if q.MinAmount != nil {
+		conds = append(conds, "amount >= "+arg(*q.MinAmount))
+	}
+	if q.MaxAmount != nil {
+		conds = append(conds, "amount <= "+arg(*q.MaxAmount))
+	}
+	if q.SpentFrom != nil {
+		conds = append(conds, "spent_at >= "+arg(*q.SpentFrom))
+	}
+	if q.SpentTo != nil {
+		conds = append(conds, "spent_at < "+arg(*q.SpentTo))
+	}
+	if q.Q != "" {
+		p := arg("%" + likeEscaper.Replace(q.Q) + "%")
+		conds = append(conds, "(title ILIKE "+p+" OR note ILIKE "+p+")")
+	}
+	if q.Expr != nil {
+		conds = append(conds, q.Expr.root.sql(arg))
+	}
+
+	return q.Scope.cond(strings.Join(conds, " AND "), args...)
+}
+
+// SQL builds the page query. It fetches one row past the limit so the caller
+// can tell whether there is a next page.
+func (q ListQuery) SQL() (string, []interface{}) {
+	where, args := q.Where()
+	col := sortColumns[q.Sort]
+
+	op, dir := ">", "ASC"
+	if q.Desc {
+		op, dir = "<", "DESC"
+	}
+
+	if q.Cursor != nil {
+		// Postgres rejects a statement with a parameter it doesn't use, so
+		// the value only goes in when it is compared.
+		if col == "id" {
+			args = append(args, q.Cursor.Id)
+			where += fmt.Sprintf(" AND id %s $%d", op, len(args))
+		} else {
+			args = append(args, q.Cursor.Value, q.Cursor.Id)
+			where += fmt.Sprintf(" AND (%s, id) %s ($%d, $%d)", col, op, len(args)-1, len(args))
+		}
+	}
+
+	order := "id " + dir
+	if col != "id" {
+		order = col + " " + dir + ", " + order
+	}
+
+	stmt := "SELECT " + expenseColumns + " FROM expenses WHERE " + where + " ORDER BY " + order
+	if q.Paginate {
+		args = append(args, q.Limit+1)
+		stmt += " LIMIT $" + strconv.Itoa(len(args))
+	}
+	return stmt, args
+}
+
+// sortParam is the sort parameter of q, as the client sends it.
+func (q ListQuery) sortParam() string {
+	if q.Desc {
+		return "-" + q.Sort
+	}
+	return q.Sort
+}
+
+// NextCursor returns the cursor pointing after exp for this query's sort.
+func (q ListQuery) NextCursor(exp Expense) Cursor {
+	cur := Cursor{Sort: q.sortParam(), Id: exp.Id}
+	switch q.Sort {
+	case "amount":
+		cur.Value = exp.Amount.String()
+	case "title":
+		cur.Value = exp.Title
+	default:
+		cur.Value = exp.Id
+	}
+	return cur
+}
+
+// cursorExpense rebuilds the sort key of the row a cursor points at. The
+// memory store orders by it, and ParseListQuery rejects a cursor it fails on
+// before its value reaches Postgres.
+func cursorExpense(sort string, cur Cursor) (Expense, error) {
+	exp := Expense{Id: cur.Id}
+	switch sort {
+	case "amount":
+		s, ok := cur.Value.(string)
+		if !ok {
+			return exp, fmt.Errorf("invalid cursor")
+		}
+		amount, err := ParseMoney(s)
+		if err != nil {
+			return exp, fmt.Errorf("invalid cursor")
+		}
+		exp.Amount = amount
+	case "title":
+		s, ok := cur.Value.(string)
+		if !ok {
+			return exp, fmt.Errorf("invalid cursor")
+		}
+		exp.Title = s
+	}
+	return exp, nil
+}
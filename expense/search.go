@@ -0,0 +1,279 @@
+package expense
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/apierror"
+)
+
+const (
+	// MaxSearchLength bounds the q parameter of the search endpoint.
+	MaxSearchLength = 200
+	// similarityThreshold is the share of the trigrams of the search text a
+	// word must have to count as a fuzzy match. It is pg_trgm's default
+	// word_similarity_threshold, which the <% operator uses.
+	similarityThreshold = 0.6
+	// snippetLength is the number of characters kept around the first match.
+	snippetLength = 120
+)
+
+// SearchQuery finds the expenses whose title, note or tags match Q by word,
+// by substring or by a close spelling.
+type SearchQuery struct {
+	Scope Scope
+	Q     string
+	Limit int
+}
+
+// SearchResult is an expense with its relevance and a snippet of the text
+// that matched. The snippet is HTML-escaped with the matches in <mark>.
+type SearchResult struct {
+	Expense
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+type SearchResults struct {
+	Query string         `json:"query"`
+	Data  []SearchResult `json:"data"`
+}
+
+func ParseSearchQuery(c echo.Context) (SearchQuery, error) {
+	q := SearchQuery{Q: strings.TrimSpace(c.QueryParam("q")), Limit: DefaultPageLimit}
+	if q.Q == "" {
+		return q, fmt.Errorf("q is required")
+	}
+	if utf8.RuneCountInString(q.Q) > MaxSearchLength {
+		return q, fmt.Errorf("q should be at most %d characters", MaxSearchLength)
+	}
+
+	if s := c.QueryParam("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxPageLimit {
+			return q, fmt.Errorf("limit should be int between 1 and %d", MaxPageLimit)
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// likeEscaper makes a value match itself literally in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SQL matches the full-text index first and falls back to trigrams for
+// substrings and misspellings. Substring matches outrank fuzzy ones. Words
+// are matched as written, with the simple configuration of migration v11,
+// and Thai text only has trigrams in a database with a UTF-8 LC_CTYPE.
+func (q SearchQuery) SQL() (string, []interface{}) {
+	text := strings.ToLower(q.Q)
+	where, args := q.Scope.cond(
+		"deleted_at IS NULL AND (search_vector @@ websearch_to_tsquery('simple', $1) OR $2 <% search_text OR search_text LIKE $3)",
+		q.Q, text, "%"+likeEscaper.Replace(text)+"%",
+	)
+	args = append(args, q.Limit)
+
+	rank := "ts_rank(search_vector, websearch_to_tsquery('simple', $1)) + word_similarity($2, search_text) + CASE WHEN search_text LIKE $3 THEN 1 ELSE 0 END"
+	return "SELECT " + expenseColumns + ", " + rank + " AS rank FROM expenses WHERE " + where +
+		" ORDER BY rank DESC, id DESC LIMIT $" + strconv.Itoa(len(args)), args
+}
+
+// rank is the in-memory equivalent of the SQL ranking, without the full-text
+// part. It returns 0 when exp doesn't match.
+func (q SearchQuery) rank(exp Expense) float64 {
+	text := strings.ToLower(exp.Title + " " + exp.Note + " " + strings.Join(exp.Tags, " "))
+	needle := strings.ToLower(q.Q)
+
+	sim := wordSimilarity(needle, text)
+	switch {
+	case strings.Contains(text, needle):
+		return 1 + sim
+	case containsAll(text, strings.Fields(needle)):
+		// Stands in for a full-text match of several words.
+		return 0.5 + sim
+	case sim >= similarityThreshold:
+		return sim
+	}
+	return 0
+}
+
+func containsAll(text string, words []string) bool {
+	for _, w := range words {
+		if !strings.Contains(text, w) {
+			return false
+		}
+	}
+	return len(words) > 0
+}
+
+// wordSimilarity approximates pg_trgm's word_similarity: the share of the
+// trigrams of needle found in text.
+func wordSimilarity(needle, text string) float64 {
+	want := trigrams(needle)
+	if len(want) == 0 {
+		return 0
+	}
+	have := trigrams(text)
+
+	found := 0
+	for t := range want {
+		if have[t] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(want))
+}
+
+// isWordRune tells the characters of a word apart from separators. Thai
+// vowels and tone marks are combining marks rather than letters.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// trigrams returns the trigrams of the words of s, each word padded with two
+// spaces in front and one behind like pg_trgm does.
+func trigrams(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !isWordRune(r) }) {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			set[string(runes[i:i+3])] = true
+		}
+	}
+	return set
+}
+
+// snippet returns the field of exp that best shows why it matched q, with
+// the matches highlighted.
+func snippet(exp Expense, q string) string {
+	fields := []string{exp.Title, exp.Note, strings.Join(exp.Tags, ", ")}
+	for _, field := range fields {
+		if s, ok := highlight(field, q); ok {
+			return s
+		}
+	}
+	s, _ := highlight(exp.Title, q)
+	return s
+}
+
+// highlight escapes text and marks the occurrences of the words of q as well
+// as the words of text spelled closely to one of them. Long text is cut
+// around the first match. ok reports whether anything was marked.
+func highlight(text, q string) (s string, ok bool) {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	marked := make([]bool, len(runes))
+
+	terms := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool { return !isWordRune(r) })
+	for _, term := range terms {
+		t := []rune(term)
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if string(lower[i:i+len(t)]) == term {
+				for j := i; j < i+len(t); j++ {
+					marked[j] = true
+				}
+			}
+		}
+	}
+
+	// Words without an exact match may still be misspellings of a term.
+	for start := 0; start < len(runes); {
+		if !isWordRune(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		hit := false
+		for end < len(runes) && isWordRune(runes[end]) {
+			hit = hit || marked[end]
+			end++
+		}
+		if !hit {
+			word := string(lower[start:end])
+			for _, term := range terms {
+				if wordSimilarity(term, word) >= similarityThreshold {
+					for j := start; j < end; j++ {
+						marked[j] = true
+					}
+					break
+				}
+			}
+		}
+		start = end
+	}
+
+	from, to := 0, len(runes)
+	for i, m := range marked {
+		if m {
+			ok = true
+			if len(runes) > snippetLength {
+				from = i - snippetLength/4
+				if from < 0 {
+					from = 0
+				}
+				if to = from + snippetLength; to > len(runes) {
+					to, from = len(runes), len(runes)-snippetLength
+				}
+			}
+			break
+		}
+	}
+	if !ok && len(runes) > snippetLength {
+		to = snippetLength
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	for i := from; i < to; {
+		j := i
+		for j < to && marked[j] == marked[i] {
+			j++
+		}
+		part := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			part = "<mark>" + part + "</mark>"
+		}
+		b.WriteString(part)
+		i = j
+	}
+	if to < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String(), ok
+}
+
+// SearchExpensesHandler ranks the caller's expenses against the q parameter.
+func (h *handler) SearchExpensesHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	q, err := ParseSearchQuery(c)
+	if err != nil {
+		return apierror.BadRequest(err.Error())
+	}
+	q.Scope = scope
+
+	ctx := c.Request().Context()
+	results, err := h.Store.Search(ctx, q)
+	if err != nil {
+		return storeErr(ctx, err)
+	}
+
+	for i := range results {
+		results[i].Snippet = snippet(results[i].Expense, q.Q)
+	}
+	return c.JSON(http.StatusOK, SearchResults{Query: q.Q, Data: results})
+}
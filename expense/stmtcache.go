@@ -0,0 +1,215 @@
+package expense
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCachedStatements bounds the cache. The list filters combine into
+	// many distinct queries, so the least recently used ones make way.
+	maxCachedStatements = 500
+	// maxCachedQueryLength keeps out the multi-row inserts of imports and
+	// batches, which are long and rarely repeat.
+	maxCachedQueryLength = 2048
+	// prepareRetryDelay is how long a query that failed to prepare runs
+	// unprepared before it is prepared again.
+	prepareRetryDelay = time.Minute
+)
+
+// stmtCache keeps prepared statements by their SQL. database/sql prepares a
+// statement again on every pool connection it runs on, so one *sql.Stmt
+// serves the whole pool.
+type stmtCache struct {
+	db   *sql.DB
+	size int
+
+	mu    sync.Mutex
+	lru   *list.List // of *cachedStmt, most recently used first
+	stmts map[string]*list.Element
+}
+
+// cachedStmt is a prepared statement, or the time its query failed to
+// prepare when stmt is nil.
+type cachedStmt struct {
+	query    string
+	stmt     *sql.Stmt
+	failedAt time.Time
+	// users counts the callers between get and release. An evicted statement
+	// is closed once the last of them is done with it.
+	users   int
+	evicted bool
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, size: maxCachedStatements, lru: list.New(), stmts: map[string]*list.Element{}}
+}
+
+func noRelease() {}
+
+// get returns the statement for query, preparing it on first use, and a
+// release func to call once the statement has run. It returns nil when query
+// isn't worth caching or can't be prepared, and the caller runs it unprepared
+// instead, which reports any error in the query itself.
+func (c *stmtCache) get(ctx context.Context, query string) (*sql.Stmt, func()) {
+	if len(query) > maxCachedQueryLength {
+		return nil, noRelease
+	}
+
+	c.mu.Lock()
+	if el, ok := c.stmts[query]; ok {
+		c.lru.MoveToFront(el)
+		e := el.Value.(*cachedStmt)
+		if e.stmt != nil {
+			e.users++
+			c.mu.Unlock()
+			return e.stmt, func() { c.release(e) }
+		}
+		if time.Since(e.failedAt) < prepareRetryDelay {
+			c.mu.Unlock()
+			return nil, noRelease
+		}
+	}
+	c.mu.Unlock()
+
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil && ctx.Err() != nil {
+		// The query isn't to blame for a request that gave up.
+		return nil, noRelease
+	}
+
+	c.mu.Lock()
+	e, evicted := c.add(query, stmt)
+	if e.stmt != nil {
+		e.users++
+	}
+	c.mu.Unlock()
+	closeAll(evicted)
+
+	if e.stmt == nil {
+		return nil, noRelease
+	}
+	return e.stmt, func() { c.release(e) }
+}
+
+// cached returns the statement for query if it is already prepared, without
+// preparing it. A transaction uses it: preparing on the pool would need a
+// second connection while the transaction holds one.
+func (c *stmtCache) cached(query string) (*sql.Stmt, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.stmts[query]
+	if !ok {
+		return nil, noRelease
+	}
+	c.lru.MoveToFront(el)
+	e := el.Value.(*cachedStmt)
+	if e.stmt == nil {
+		return nil, noRelease
+	}
+	e.users++
+	return e.stmt, func() { c.release(e) }
+}
+
+// prepare prepares query and adds it to the cache.
+func (c *stmtCache) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	e, evicted := c.add(query, stmt)
+	c.mu.Unlock()
+	closeAll(evicted)
+	return e.stmt, nil
+}
+
+// add records the outcome of preparing query, where a nil stmt is a failure,
+// and evicts the least recently used entries past the size of the cache. It
+// returns the entry of query and the statements to close once c.mu is
+// released. c.mu must be held.
+func (c *stmtCache) add(query string, stmt *sql.Stmt) (*cachedStmt, []*sql.Stmt) {
+	var closing []*sql.Stmt
+	if el, ok := c.stmts[query]; ok {
+		c.lru.MoveToFront(el)
+		e := el.Value.(*cachedStmt)
+		switch {
+		case e.stmt != nil:
+			// Another request prepared the same query meanwhile.
+			if stmt != nil {
+				closing = append(closing, stmt)
+			}
+		case stmt != nil:
+			e.stmt = stmt
+		default:
+			e.failedAt = time.Now()
+		}
+		return e, closing
+	}
+
+	e := &cachedStmt{query: query, stmt: stmt}
+	if stmt == nil {
+		e.failedAt = time.Now()
+	}
+	c.stmts[query] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		if stmt := c.evict(c.lru.Back()); stmt != nil {
+			closing = append(closing, stmt)
+		}
+	}
+	return e, closing
+}
+
+// evict drops el from the cache and returns its statement if nobody is
+// using it, for the caller to close. c.mu must be held.
+func (c *stmtCache) evict(el *list.Element) *sql.Stmt {
+	e := c.lru.Remove(el).(*cachedStmt)
+	delete(c.stmts, e.query)
+	e.evicted = true
+	if e.users > 0 {
+		return nil
+	}
+	return e.stmt
+}
+
+// release ends a use of e's statement, closing it if it was evicted meanwhile.
+func (c *stmtCache) release(e *cachedStmt) {
+	c.mu.Lock()
+	e.users--
+	done := e.evicted && e.users == 0
+	c.mu.Unlock()
+	if done {
+		e.stmt.Close()
+	}
+}
+
+func closeAll(stmts []*sql.Stmt) {
+	for _, stmt := range stmts {
+		stmt.Close()
+	}
+}
+
+// Close closes every cached statement. Statements still running are closed
+// as soon as they are done.
+func (c *stmtCache) Close() error {
+	c.mu.Lock()
+	var closing []*sql.Stmt
+	for c.lru.Len() > 0 {
+		if stmt := c.evict(c.lru.Front()); stmt != nil {
+			closing = append(closing, stmt)
+		}
+	}
+	c.mu.Unlock()
+
+	var err error
+	for _, stmt := range closing {
+		if cerr := stmt.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package expense
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrNotFound is returned by an ExpenseStore when no live expense has the
+// given id within the scope.
+var ErrNotFound = errors.New("expense not found")
+
+// ErrVersionMismatch is returned by Update when the expense exists but its
+// version is not the one the caller expected.
+var ErrVersionMismatch = errors.New("expense version mismatch")
+
+// Scope limits store operations to the expenses of one owner. All lifts the
+// limit and is only granted to admins.
+type Scope struct {
+	Owner string
+	All   bool
+}
+
+// OwnedBy reports whether exp is visible within the scope.
+func (s Scope) OwnedBy(exp Expense) bool {
+	return s.All || exp.OwnerId == s.Owner
+}
+
+// cond appends the owner condition to a WHERE clause built from args.
+func (s Scope) cond(where string, args ...interface{}) (string, []interface{}) {
+	if s.All {
+		return where, args
+	}
+	args = append(args, s.Owner)
+	return where + " AND owner_id=$" + strconv.Itoa(len(args)), args
+}
+
+// ExpenseStore persists expenses. Deleted expenses are kept in the trash until
+// they are restored or purged, and are invisible to Get, List and Update.
+// Expenses outside the given scope behave as if they did not exist.
+type ExpenseStore interface {
+	// Create stores exp and sets its Id. exp.OwnerId must be set.
+	Create(ctx context.Context, exp *Expense) error
+	// CreateBatch stores all of exps or, on error, none of them.
+	CreateBatch(ctx context.Context, exps []*Expense) error
+	Get(ctx context.Context, scope Scope, id int) (Expense, error)
+	// List returns the expenses matching q. When q.Paginate is set it returns
+	// up to q.Limit+1 rows so the caller can tell whether there is a next page.
+	List(ctx context.Context, q ListQuery) ([]Expense, error)
+	// Count returns the number of expenses matching q, ignoring its cursor.
+	Count(ctx context.Context, q ListQuery) (int, error)
+	Summary(ctx context.Context, q SummaryQuery) ([]SummaryRow, error)
+	// Search returns up to q.Limit matching expenses, best match first.
+	// Snippets are left to the caller.
+	Search(ctx context.Context, q SearchQuery) ([]SearchResult, error)
+	// Update stores exp's editable fields and refreshes its server-managed
+	// ones, including a new Version. A non-zero exp.Version must match the
+	// stored one.
+	Update(ctx context.Context, scope Scope, exp *Expense) error
+	// Patch locks the expense, lets fn edit it and stores only the columns fn
+	// reports as changed, all in one transaction. An error from fn aborts the
+	// patch and is returned as is. A non-zero version must match the stored one.
+	Patch(ctx context.Context, scope Scope, id int, version int, fn PatchFunc) (Expense, error)
+	Delete(ctx context.Context, scope Scope, id int) error
+	// Batch applies ops in one transaction and returns an error for each of
+	// them. When atomic is set a failing op rolls back the others, which then
+	// fail with ErrBatchAborted. The returned error is for the transaction
+	// itself.
+	Batch(ctx context.Context, scope Scope, ops []BatchOp, atomic bool) ([]error, error)
+
+	Trash(ctx context.Context, scope Scope) ([]Expense, error)
+	Restore(ctx context.Context, scope Scope, id int) (Expense, error)
+	// Purge permanently removes expenses deleted before the given time.
+	Purge(ctx context.Context, scope Scope, before time.Time) (int64, error)
+}
@@ -0,0 +1,132 @@
+package expense
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/labstack/echo/v4"
+)
+
+// periods maps the group_by periods to date_trunc fields. Weeks start on
+// Monday as in Postgres.
+var periods = map[string]bool{"day": true, "week": true, "month": true}
+
+// SummaryQuery aggregates the expenses matching Filter, optionally grouped by
+// tag and/or by a calendar period in Location.
+type SummaryQuery struct {
+	Filter     ListQuery
+	GroupByTag bool
+	// Period is "", "day", "week" or "month".
+	Period   string
+	Location *time.Location
+}
+
+type SummaryRow struct {
+	Tag string `json:"tag,omitempty"`
+	// Period is the first day of the bucket in the query's time zone.
+	Period  string `json:"period,omitempty"`
+	Count   int    `json:"count"`
+	Total   Money  `json:"total"`
+	Average Money  `json:"average"`
+	Min     Money  `json:"min"`
+	Max     Money  `json:"max"`
+}
+
+type Summary struct {
+	GroupBy []string     `json:"group_by"`
+	TZ      string       `json:"tz"`
+	Groups  []SummaryRow `json:"groups"`
+}
+
+func ParseSummaryQuery(c echo.Context) (SummaryQuery, error) {
+	q := SummaryQuery{Filter: ListQuery{Sort: "id"}, Location: time.UTC}
+
+	// LoadLocation also takes "Local" and "" for the server's zone and UTC,
+	// names Postgres doesn't know, so only IANA names get through.
+	if tzs, ok := c.QueryParams()["tz"]; ok {
+		tz := tzs[0]
+		loc, err := time.LoadLocation(tz)
+		if err != nil || tz == "" || loc == time.Local {
+			return q, fmt.Errorf("tz should be an IANA time zone name: %q", tz)
+		}
+		q.Location = loc
+	}
+
+	if s := c.QueryParam("group_by"); s != "" {
+		for _, g := range strings.Split(s, ",") {
+			switch {
+			case g == "tag":
+				q.GroupByTag = true
+			case periods[g] && q.Period == "":
+				q.Period = g
+			default:
+				return q, fmt.Errorf("group_by should be tag and/or one of day, week, month: %q", s)
+			}
+		}
+	}
+
+	err := q.Filter.parseFilters(c, q.Location)
+	return q, err
+}
+
+func (q SummaryQuery) GroupBy() []string {
+	groups := []string{}
+	if q.GroupByTag {
+		groups = append(groups, "tag")
+	}
+	if q.Period != "" {
+		groups = append(groups, q.Period)
+	}
+	return groups
+}
+
+// SQL builds the aggregation. Grouping by tag counts an expense once per tag,
+// so tag totals can add up to more than the overall total.
+func (q SummaryQuery) SQL() (string, []interface{}) {
+	where, args := q.Filter.Where()
+
+	cols, groups := []string{}, []string{}
+	from := "expenses"
+	if q.GroupByTag {
+		from += " CROSS JOIN LATERAL unnest(tags) AS t(tag)"
+		cols = append(cols, "t.tag")
+		groups = append(groups, "t.tag")
+	}
+	if q.Period != "" {
+		args = append(args, q.Location.String())
+		period := fmt.Sprintf("date_trunc('%s', spent_at AT TIME ZONE $%d)", q.Period, len(args))
+		cols = append(cols, period)
+		groups = append(groups, period)
+	}
+
+	cols = append(cols, "count(*)", "COALESCE(sum(amount), 0)", "COALESCE(round(avg(amount), 2), 0)", "COALESCE(min(amount), 0)", "COALESCE(max(amount), 0)")
+	stmt := "SELECT " + strings.Join(cols, ", ") + " FROM " + from + " WHERE " + where
+	if len(groups) > 0 {
+		g := strings.Join(groups, ", ")
+		stmt += " GROUP BY " + g + " ORDER BY " + g
+	}
+	return stmt, args
+}
+
+func (h *handler) GetSummaryHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	q, err := ParseSummaryQuery(c)
+	if err != nil {
+		return queryErr(err)
+	}
+	q.Filter.Scope = scope
+
+	rows, err := h.Store.Summary(c.Request().Context(), q)
+	if err != nil {
+		return storeErr(c.Request().Context(), err)
+	}
+
+	return c.JSON(http.StatusOK, Summary{GroupBy: q.GroupBy(), TZ: q.Location.String(), Groups: rows})
+}
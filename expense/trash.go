@@ -0,0 +1,67 @@
+package expense
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/apierror"
+)
+
+func (h *handler) GetTrashHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	exps, err := h.Store.Trash(c.Request().Context(), scope)
+	if err != nil {
+		return storeErr(c.Request().Context(), err)
+	}
+
+	return c.JSON(http.StatusOK, exps)
+}
+
+func (h *handler) RestoreExpenseHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	rowId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apierror.BadRequest("id should be int")
+	}
+
+	exp, err := h.Store.Restore(c.Request().Context(), scope, rowId)
+	if err != nil {
+		if err == ErrNotFound {
+			return apierror.New(http.StatusNotFound, apierror.CodeExpenseNotFound, "expense not found in trash with given id")
+		}
+		return storeErr(c.Request().Context(), err)
+	}
+
+	return c.JSON(http.StatusOK, exp)
+}
+
+// PurgeTrashHandler permanently removes expenses that have been in the trash
+// longer than the handler's retention window.
+func (h *handler) PurgeTrashHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
+	n, err := h.PurgeTrash(c.Request().Context(), scope, time.Now())
+	if err != nil {
+		return storeErr(c.Request().Context(), err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]int64{"purged": n})
+}
+
+func (h *handler) PurgeTrash(ctx context.Context, scope Scope, now time.Time) (int64, error) {
+	return h.Store.Purge(ctx, scope, now.Add(-h.Retention))
+}
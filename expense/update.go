@@ -1,37 +1,39 @@
 package expense
 
 import (
-	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/labstack/echo/v4"
-	"github.com/lib/pq"
+	"github.com/teerit/assessment/apierror"
 )
 
 func (h *handler) UpdateExpenseHandler(c echo.Context) error {
+	scope, ok := scopeOf(c)
+	if !ok {
+		return unauthorized()
+	}
+
 	rowId, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+		return apierror.BadRequest("id should be int")
 	}
 
 	exp := Expense{}
 	err = c.Bind(&exp)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+		return bindErr(err)
 	}
-
-	stmt, err := h.DB.Prepare(`UPDATE expenses SET title=$2, amount=$3, note=$4, tags=$5 WHERE id=$1`)
-	if err != nil {
-		fmt.Println("ERR::", err.Error())
-		return c.JSON(http.StatusBadRequest, Err{Message: err.Error()})
+	if verr := exp.Validate(); verr != nil {
+		return invalid(verr)
 	}
 
-	if _, err := stmt.Exec(rowId, exp.Title, exp.Amount, exp.Note, pq.Array(exp.Tags)); err != nil {
-		fmt.Println("ERR::", err.Error())
-		return c.JSON(http.StatusInternalServerError, Err{Message: err.Error()})
+	exp.Id = rowId
+	exp.Version = parseIfMatch(c.Request().Header.Get("If-Match"))
+	if err := h.Store.Update(c.Request().Context(), scope, &exp); err != nil {
+		return storeErr(c.Request().Context(), err)
 	}
 
-	exp.Id = rowId
+	c.Response().Header().Set("ETag", exp.ETag())
 	return c.JSON(http.StatusOK, exp)
 }
@@ -0,0 +1,113 @@
+package expense
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/teerit/assessment/apierror"
+)
+
+const (
+	MaxTitleLength = 200
+	MaxNoteLength  = 2000
+	MaxTags        = 20
+	MaxTagLength   = 50
+)
+
+// FieldError is a rule an expense field breaks.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every rule an expense breaks. It is sent as the 422
+// response body.
+type ValidationError struct {
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Message
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// rule is one check on an expense. Only the first failing rule of a field is
+// reported.
+type rule struct {
+	field   string
+	ok      func(exp *Expense) bool
+	message string
+}
+
+var expenseRules = []rule{
+	{"title", func(exp *Expense) bool { return strings.TrimSpace(exp.Title) != "" }, "title is required"},
+	{"title", func(exp *Expense) bool { return utf8.RuneCountInString(exp.Title) <= MaxTitleLength },
+		fmt.Sprintf("title should be at most %d characters", MaxTitleLength)},
+	{"amount", func(exp *Expense) bool { return exp.Amount > 0 }, "amount should be greater than 0"},
+	{"note", func(exp *Expense) bool { return utf8.RuneCountInString(exp.Note) <= MaxNoteLength },
+		fmt.Sprintf("note should be at most %d characters", MaxNoteLength)},
+	{"tags", func(exp *Expense) bool { return len(exp.Tags) <= MaxTags },
+		fmt.Sprintf("tags should have at most %d items", MaxTags)},
+	{"tags", func(exp *Expense) bool {
+		for _, tag := range exp.Tags {
+			if tag == "" {
+				return false
+			}
+		}
+		return true
+	}, "tags should not be blank"},
+	{"tags", func(exp *Expense) bool {
+		for _, tag := range exp.Tags {
+			if utf8.RuneCountInString(tag) > MaxTagLength {
+				return false
+			}
+		}
+		return true
+	}, fmt.Sprintf("tags should be at most %d characters each", MaxTagLength)},
+}
+
+// NormalizeTags trims and lowercases tags and drops repeats, keeping the
+// first occurrence. Blank tags are kept so that Validate can report them.
+func NormalizeTags(tags []string) []string {
+	out := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	return out
+}
+
+// Validate normalizes the tags of exp and checks it against expenseRules. It
+// returns nil when exp is valid.
+func (exp *Expense) Validate() *ValidationError {
+	exp.Tags = NormalizeTags(exp.Tags)
+
+	errs := []FieldError{}
+	failed := map[string]bool{}
+	for _, r := range expenseRules {
+		if failed[r.field] || r.ok(exp) {
+			continue
+		}
+		failed[r.field] = true
+		errs = append(errs, FieldError{Field: r.field, Message: r.message})
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Message: "expense is invalid", Errors: errs}
+	}
+	return nil
+}
+
+func invalid(err *ValidationError) error {
+	return apierror.New(http.StatusUnprocessableEntity, apierror.CodeValidationFailed, err.Message).WithErrors(err.Errors)
+}
@@ -0,0 +1,117 @@
+// Package health serves the liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/db"
+	"github.com/teerit/assessment/logging"
+)
+
+// DefaultTimeout bounds the checks of one readiness probe.
+const DefaultTimeout = 2 * time.Second
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+	StatusFail        = "fail"
+	StatusPending     = "pending"
+)
+
+type Check struct {
+	Status    string   `json:"status"`
+	LatencyMs int64    `json:"latency_ms,omitempty"`
+	Version   int      `json:"version,omitempty"`
+	Pending   []string `json:"pending,omitempty"`
+}
+
+type Report struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+// Checker reports whether the API can serve requests.
+type Checker struct {
+	DB       *sql.DB
+	Migrator *db.Migrator
+	Timeout  time.Duration
+}
+
+func NewChecker(conn *sql.DB) (*Checker, error) {
+	m, err := db.NewMigrator(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &Checker{DB: conn, Migrator: m, Timeout: DefaultTimeout}, nil
+}
+
+// LiveHandler answers as long as the process can serve HTTP. It checks
+// nothing else so a database outage doesn't get the process restarted.
+func LiveHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, Report{Status: StatusOK})
+}
+
+// ReadyHandler pings the database and compares the applied migrations with
+// the ones in the binary. It answers 503 until both pass. The probe needs no
+// credentials, so why a check failed is only logged.
+func (ch *Checker) ReadyHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), ch.Timeout)
+	defer cancel()
+
+	report := ch.Check(ctx)
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+		logging.FromContext(ctx).Warn("not ready", "checks", report.Checks)
+	}
+	return c.JSON(status, report)
+}
+
+// Check runs every readiness check.
+func (ch *Checker) Check(ctx context.Context) Report {
+	report := Report{Status: StatusOK, Checks: map[string]Check{
+		"database":   ch.checkDB(ctx),
+		"migrations": ch.checkMigrations(ctx),
+	}}
+	for _, check := range report.Checks {
+		if check.Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+	return report
+}
+
+func (ch *Checker) checkDB(ctx context.Context) Check {
+	start := time.Now()
+	if err := ch.DB.PingContext(ctx); err != nil {
+		logging.FromContext(ctx).Warn("database check failed", "error", err)
+		return Check{Status: StatusFail}
+	}
+	return Check{Status: StatusOK, LatencyMs: time.Since(start).Milliseconds()}
+}
+
+func (ch *Checker) checkMigrations(ctx context.Context) Check {
+	pending, err := ch.Migrator.Pending(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Warn("migrations check failed", "error", err)
+		return Check{Status: StatusFail}
+	}
+
+	check := Check{Status: StatusOK}
+	for _, mig := range ch.Migrator.Migrations {
+		if len(pending) > 0 && mig.Version >= pending[0].Version {
+			break
+		}
+		check.Version = mig.Version
+	}
+	for _, mig := range pending {
+		check.Status = StatusPending
+		check.Pending = append(check.Pending, fmt.Sprintf("v%d__%s", mig.Version, mig.Name))
+	}
+	return check
+}
@@ -0,0 +1,104 @@
+//go:build unit
+// +build unit
+
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/teerit/assessment/db"
+)
+
+func TestLiveHandler(t *testing.T) {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/healthz", nil), rec)
+
+	if assert.NoError(t, LiveHandler(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"status":"ok"}`, rec.Body.String())
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	migrations := []db.Migration{
+		{Version: 1, Name: "init", Checksum: "aaa"},
+		{Version: 2, Name: "add_note", Checksum: "bbb"},
+	}
+	tests := []struct {
+		name         string
+		pingErr      error
+		applied      *sqlmock.Rows
+		expectStatus int
+		expectChecks map[string]Check
+	}{
+		{
+			name:         "TestReadyHandlerReady",
+			applied:      sqlmock.NewRows([]string{"version", "checksum"}).AddRow(1, "aaa").AddRow(2, "bbb"),
+			expectStatus: http.StatusOK,
+			expectChecks: map[string]Check{
+				"database":   {Status: StatusOK},
+				"migrations": {Status: StatusOK, Version: 2},
+			},
+		},
+		{
+			name:         "TestReadyHandlerPendingMigration",
+			applied:      sqlmock.NewRows([]string{"version", "checksum"}).AddRow(1, "aaa"),
+			expectStatus: http.StatusServiceUnavailable,
+			expectChecks: map[string]Check{
+				"database":   {Status: StatusOK},
+				"migrations": {Status: StatusPending, Version: 1, Pending: []string{"v2__add_note"}},
+			},
+		},
+		{
+			name:         "TestReadyHandlerDatabaseDown",
+			pingErr:      errors.New("connection refused"),
+			expectStatus: http.StatusServiceUnavailable,
+			expectChecks: map[string]Check{
+				"database":   {Status: StatusFail},
+				"migrations": {Status: StatusFail},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			mock.ExpectPing().WillReturnError(test.pingErr)
+			query := mock.ExpectQuery("SELECT version, checksum FROM schema_migrations")
+			if test.pingErr != nil {
+				query.WillReturnError(test.pingErr)
+			} else {
+				query.WillReturnRows(test.applied)
+			}
+
+			ch := &Checker{DB: conn, Migrator: &db.Migrator{DB: conn, Migrations: migrations}, Timeout: DefaultTimeout}
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/readyz", nil), rec)
+
+			if assert.NoError(t, ch.ReadyHandler(c)) {
+				assert.Equal(t, test.expectStatus, rec.Code)
+				report := Report{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+				for name, check := range report.Checks {
+					check.LatencyMs = 0
+					report.Checks[name] = check
+				}
+				assert.Equal(t, test.expectChecks, report.Checks)
+				assert.NotContains(t, rec.Body.String(), "connection refused")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
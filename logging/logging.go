@@ -0,0 +1,196 @@
+// Package logging writes structured logs as one JSON object per line.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("log level should be one of %s: %q", strings.Join(levelNames, ", "), s)
+}
+
+// Redacted is logged in place of the value of every field named in
+// RedactedKeys, at any depth, so that what users write about their expenses
+// stays out of logs.
+const Redacted = "[REDACTED]"
+
+// RedactedKeys are the field names whose values are never logged.
+var RedactedKeys = map[string]bool{"title": true, "note": true}
+
+// Logger writes leveled records with a fixed set of fields. It is safe for
+// concurrent use; With returns a child sharing the same output.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	fields []interface{}
+	now    func() time.Time
+}
+
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, level: level, now: time.Now}
+}
+
+// Default is used when no logger was put on a context.
+var Default = New(os.Stdout, LevelInfo)
+
+// With returns a logger that adds the key/value pairs kv to every record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &child
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(LevelInfo, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(LevelWarn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Log writes msg with the logger's fields followed by kv, which alternates
+// string keys and values. Errors are logged by their message.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(`{"time":`)
+	writeValue(buf, l.now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeValue(buf, msg)
+
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			key = fmt.Sprint(fields[i])
+		}
+		var v interface{} = "!MISSING"
+		if i+1 < len(fields) {
+			v = fields[i+1]
+		}
+		buf.WriteByte(',')
+		writeValue(buf, key)
+		buf.WriteByte(':')
+		if RedactedKeys[key] {
+			v = Redacted
+		}
+		writeValue(buf, v)
+	}
+	buf.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+func writeValue(buf *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case time.Time:
+		v = x.Format(time.RFC3339Nano)
+	case time.Duration:
+		v = x.String()
+	case fmt.Stringer:
+		v = x.String()
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	if len(b) > 0 && (b[0] == '{' || b[0] == '[') {
+		b = redact(b)
+	}
+	buf.Write(b)
+}
+
+// redact blanks out the RedactedKeys inside a JSON object or array.
+func redact(b []byte) []byte {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return b
+	}
+	if !redactValue(v) {
+		return b
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return b
+	}
+	return out
+}
+
+func redactValue(v interface{}) bool {
+	changed := false
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, child := range x {
+			if RedactedKeys[k] {
+				x[k], changed = Redacted, true
+				continue
+			}
+			changed = redactValue(child) || changed
+		}
+	case []interface{}:
+		for _, child := range x {
+			changed = redactValue(child) || changed
+		}
+	}
+	return changed
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger on ctx, or Default.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return Default
+}
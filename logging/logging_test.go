@@ -0,0 +1,73 @@
+//go:build unit
+// +build unit
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLogger(level Level) (*Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	l := New(buf, level)
+	l.now = func() time.Time { return time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC) }
+	return l, buf
+}
+
+func TestLoggerRecord(t *testing.T) {
+	l, buf := newTestLogger(LevelInfo)
+
+	l.With("request_id", "abc").Error("request failed", "status", 500, "error", errors.New("boom"), "took", 1500*time.Millisecond)
+
+	assert.Equal(t, `{"time":"2022-12-01T10:00:00Z","level":"error","msg":"request failed","request_id":"abc","status":500,"error":"boom","took":"1.5s"}`+"\n", buf.String())
+}
+
+func TestLoggerLevel(t *testing.T) {
+	l, buf := newTestLogger(LevelWarn)
+
+	l.Debug("debug")
+	l.Info("info")
+	assert.Empty(t, buf.String())
+
+	l.Warn("warn")
+	assert.Contains(t, buf.String(), `"level":"warn"`)
+}
+
+func TestLoggerRedaction(t *testing.T) {
+	type expense struct {
+		Id    int      `json:"id"`
+		Title string   `json:"title"`
+		Note  string   `json:"note"`
+		Tags  []string `json:"tags"`
+	}
+	l, buf := newTestLogger(LevelInfo)
+
+	l.Info("created",
+		"title", "strawberry smoothie",
+		"expense", expense{Id: 1, Title: "strawberry smoothie", Note: "โปรโมชั่น", Tags: []string{"food"}},
+		"batch", []map[string]interface{}{{"note": "secret", "amount": 79}},
+	)
+
+	record := map[string]interface{}{}
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &record)) {
+		assert.Equal(t, Redacted, record["title"])
+		assert.Equal(t, map[string]interface{}{"id": float64(1), "title": Redacted, "note": Redacted, "tags": []interface{}{"food"}}, record["expense"])
+		assert.Equal(t, []interface{}{map[string]interface{}{"note": Redacted, "amount": float64(79)}}, record["batch"])
+	}
+	assert.NotContains(t, buf.String(), "smoothie")
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarn, level)
+
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+// Package metrics exposes the API's Prometheus metrics.
+package metrics
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/teerit/assessment/middleware"
+)
+
+// MaxTrackedTags bounds the tag label of the per-tag amount counter. Tags are
+// chosen by users, so beyond this many they are counted as OtherTag.
+const MaxTrackedTags = 200
+
+const (
+	NoTag    = "(none)"
+	OtherTag = "(other)"
+)
+
+// Registry holds every metric of the API, including the Go runtime and
+// process collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	expensesCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "expenses_created_total",
+		Help: "Expenses created through any endpoint.",
+	})
+
+	amountRecorded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "expenses_amount_baht_total",
+		Help: "Amount of created expenses in baht, by tag. An expense counts once for each of its tags.",
+	}, []string{"tag"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requests, latency, expensesCreated, amountRecorded,
+	)
+}
+
+// RegisterDB adds the connection pool gauges of db under the given name.
+func RegisterDB(db *sql.DB, name string) error {
+	return Registry.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+// Middleware counts and times every request. Requests that matched no route
+// share the middleware.Unmatched route label.
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		status := middleware.Status(c, err)
+		route, method := middleware.Route(c, status), c.Request().Method
+		requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		latency.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+var tags = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+func tagLabel(tag string) string {
+	tags.Lock()
+	defer tags.Unlock()
+
+	if tags.seen[tag] {
+		return tag
+	}
+	if len(tags.seen) >= MaxTrackedTags {
+		return OtherTag
+	}
+	tags.seen[tag] = true
+	return tag
+}
+
+// ExpenseCreated records a created expense of amount baht.
+func ExpenseCreated(amount float64, expenseTags []string) {
+	expensesCreated.Inc()
+	if len(expenseTags) == 0 {
+		amountRecorded.WithLabelValues(NoTag).Add(amount)
+		return
+	}
+	for _, tag := range expenseTags {
+		amountRecorded.WithLabelValues(tagLabel(tag)).Add(amount)
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format to scrapers that
+// send token as a bearer token. It is separate from the API authentication
+// so that the scraper needs no API credentials.
+func Handler(token string) echo.HandlerFunc {
+	h := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+	want := []byte("Bearer " + token)
+	return func(c echo.Context) error {
+		got := []byte(c.Request().Header.Get(echo.HeaderAuthorization))
+		if token == "" || subtle.ConstantTimeCompare(got, want) != 1 {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="metrics"`)
+			return echo.NewHTTPError(http.StatusUnauthorized, "missing or invalid metrics token")
+		}
+		h.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+//go:build unit
+// +build unit
+
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware)
+	e.GET("/expenses/:id", func(c echo.Context) error {
+		if c.Param("id") == "0" {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	for _, path := range []string{"/expenses/1", "/expenses/2", "/expenses/0", "/nowhere"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(requests.WithLabelValues("GET", "/expenses/:id", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("GET", "/expenses/:id", "404")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("GET", "unmatched", "404")))
+}
+
+func TestExpenseCreated(t *testing.T) {
+	before := testutil.ToFloat64(expensesCreated)
+
+	ExpenseCreated(79.5, []string{"food", "beverage"})
+	ExpenseCreated(10, nil)
+
+	assert.Equal(t, before+2, testutil.ToFloat64(expensesCreated))
+	assert.Equal(t, 79.5, testutil.ToFloat64(amountRecorded.WithLabelValues("food")))
+	assert.Equal(t, 79.5, testutil.ToFloat64(amountRecorded.WithLabelValues("beverage")))
+	assert.Equal(t, 10.0, testutil.ToFloat64(amountRecorded.WithLabelValues(NoTag)))
+
+	for i := 0; i < MaxTrackedTags; i++ {
+		ExpenseCreated(1, []string{"tag-" + strconv.Itoa(i)})
+	}
+	assert.Greater(t, testutil.ToFloat64(amountRecorded.WithLabelValues(OtherTag)), 0.0)
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		token          string
+		authorization  string
+		expectedStatus int
+	}{
+		{name: "TestMetricsWithToken", token: "s3cret", authorization: "Bearer s3cret", expectedStatus: http.StatusOK},
+		{name: "TestMetricsWrongToken", token: "s3cret", authorization: "Bearer nope", expectedStatus: http.StatusUnauthorized},
+		{name: "TestMetricsNoToken", token: "s3cret", expectedStatus: http.StatusUnauthorized},
+		{name: "TestMetricsNotConfigured", authorization: "Bearer ", expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := echo.New()
+			e.GET("/metrics", Handler(test.token))
+
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if test.authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, test.authorization)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expectedStatus, rec.Code)
+			if test.expectedStatus == http.StatusOK {
+				assert.Contains(t, rec.Body.String(), "expenses_created_total")
+				assert.Contains(t, rec.Body.String(), "go_goroutines")
+			}
+		})
+	}
+}
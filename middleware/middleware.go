@@ -1,36 +1,142 @@
 package middleware
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/apierror"
+	"github.com/teerit/assessment/auth"
+	"github.com/teerit/assessment/logging"
 )
 
-// https://yourbasic.org/golang/format-parse-string-time-date-example/
-const (
-	layoutUS = "January 2, 2006"
-)
+// Authenticate tries each authenticator in order and stores the first
+// accepted principal on the context under auth.ContextKey. Requests no
+// authenticator recognises are rejected with 401.
+func Authenticate(authenticators ...auth.Authenticator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, a := range authenticators {
+				p, err := a.Authenticate(c.Request())
+				if errors.Is(err, auth.ErrNoCredentials) {
+					continue
+				}
+				if err != nil {
+					if !errors.Is(err, auth.ErrInvalidCredentials) {
+						logging.FromContext(c.Request().Context()).Error("authentication failed", "error", err)
+					}
+					return unauthorized(c)
+				}
 
-func DateFormatAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		authHeader := c.Request().Header.Get("Authorization")
-		_, err := time.Parse(layoutUS, authHeader)
-		if err != nil {
-			return c.String(http.StatusUnauthorized, "Unauthorized")
+				c.Set(auth.ContextKey, p)
+				return next(c)
+			}
+			return unauthorized(c)
 		}
-		return next(c)
 	}
 }
 
-func RequestLogger(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		req := c.Request()
-		res := c.Response()
-		c.Set("customValueFromContext", time.Now().String())
-		err := next(c)
-		fmt.Printf("REQUEST: uri: %v, status: %v, datetime: %v\n", req.RequestURI, res.Status, c.Get("customValueFromContext"))
-		return err
+func unauthorized(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	return apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "missing or invalid credentials")
+}
+
+// HeaderRequestID carries the correlation id of a request.
+const HeaderRequestID = "X-Request-ID"
+
+// RequestLogger gives every request an id, taken from X-Request-ID when the
+// client sent a usable one, and a logger carrying it on the request context.
+// Once the request is done it logs one record with its outcome. Only the route
+// template is logged, never the query string.
+//
+// It is the outermost middleware and the one that renders a handler's error,
+// so the record has the status that was sent. The middleware inside it only
+// observe the status, with Status.
+func RequestLogger(logger *logging.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+			res := c.Response()
+
+			id := req.Header.Get(HeaderRequestID)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			res.Header().Set(HeaderRequestID, id)
+
+			l := logger.With("request_id", id)
+			c.SetRequest(req.WithContext(logging.NewContext(req.Context(), l)))
+
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			level := logging.LevelInfo
+			switch {
+			case res.Status >= http.StatusInternalServerError:
+				level = logging.LevelError
+			case res.Status >= http.StatusBadRequest:
+				level = logging.LevelWarn
+			}
+			l.Log(level, "request",
+				"method", req.Method,
+				"path", Route(c, res.Status),
+				"status", res.Status,
+				"duration_ms", float64(time.Since(start).Microseconds())/1000,
+				"bytes_in", req.ContentLength,
+				"bytes_out", res.Size,
+				"remote_ip", c.RealIP(),
+			)
+			return nil
+		}
 	}
 }
+
+// Unmatched is the Route of requests that matched no route.
+const Unmatched = "unmatched"
+
+// Status returns the status of the response to a request its handler returned
+// err for. The error isn't rendered until it reaches RequestLogger, so until
+// then the status is the one err will get.
+func Status(c echo.Context, err error) int {
+	if err == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+	return apierror.Status(err)
+}
+
+// Route returns the route template the request matched, for use once the
+// request is done with the given status. Echo reports the raw request path
+// when no route matched; it is replaced with Unmatched so clients can't add
+// arbitrary values to logs, metric labels and span names.
+func Route(c echo.Context, status int) string {
+	route := c.Path()
+	if route == "" || (route == c.Request().URL.Path && (status == http.StatusNotFound || status == http.StatusMethodNotAllowed)) {
+		return Unmatched
+	}
+	return route
+}
+
+// validRequestID accepts short ids of visible ASCII so that a client can't
+// inject anything odd into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' || id[i] == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,144 @@
+//go:build unit
+// +build unit
+
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/teerit/assessment/apierror"
+	"github.com/teerit/assessment/logging"
+)
+
+func TestRequestLogger(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestID      string
+		path           string
+		expectedID     string
+		expectedStatus int
+		expectedLevel  string
+	}{
+		{
+			name:           "TestPropagateRequestID",
+			requestID:      "req-123",
+			path:           "/expenses/1?q=strawberry",
+			expectedID:     "req-123",
+			expectedStatus: http.StatusOK,
+			expectedLevel:  "info",
+		},
+		{
+			name:           "TestGenerateRequestID",
+			path:           "/expenses/1",
+			expectedStatus: http.StatusOK,
+			expectedLevel:  "info",
+		},
+		{
+			name:           "TestReplaceBadRequestID",
+			requestID:      "bad\"id",
+			path:           "/expenses/1",
+			expectedStatus: http.StatusOK,
+			expectedLevel:  "info",
+		},
+		{
+			name:           "TestLogHandlerError",
+			requestID:      "req-404",
+			path:           "/expenses/404",
+			expectedID:     "req-404",
+			expectedStatus: http.StatusNotFound,
+			expectedLevel:  "warn",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			e := echo.New()
+			e.HTTPErrorHandler = apierror.HTTPErrorHandler
+			e.Use(RequestLogger(logging.New(buf, logging.LevelInfo)))
+
+			var handlerLog *logging.Logger
+			e.GET("/expenses/:id", func(c echo.Context) error {
+				handlerLog = logging.FromContext(c.Request().Context())
+				handlerLog.Info("handling", "title", "strawberry smoothie")
+				if c.Param("id") == "404" {
+					return apierror.New(http.StatusNotFound, apierror.CodeExpenseNotFound, "expense not found with given id")
+				}
+				return c.String(http.StatusOK, "ok")
+			})
+
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.requestID != "" {
+				req.Header.Set(HeaderRequestID, test.requestID)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(HeaderRequestID)
+			if test.expectedID != "" {
+				assert.Equal(t, test.expectedID, id)
+			} else {
+				assert.Len(t, id, 32)
+			}
+			assert.Equal(t, test.expectedStatus, rec.Code)
+			assert.NotContains(t, buf.String(), "strawberry")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if assert.Len(t, lines, 2) {
+				handled, record := map[string]interface{}{}, map[string]interface{}{}
+				assert.NoError(t, json.Unmarshal([]byte(lines[0]), &handled))
+				assert.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+
+				assert.Equal(t, id, handled["request_id"])
+				assert.Equal(t, id, record["request_id"])
+				assert.Equal(t, test.expectedLevel, record["level"])
+				assert.Equal(t, "GET", record["method"])
+				assert.Equal(t, "/expenses/:id", record["path"])
+				assert.Equal(t, float64(test.expectedStatus), record["status"])
+				assert.Contains(t, record, "duration_ms")
+				assert.Contains(t, record, "bytes_out")
+				assert.Contains(t, record, "remote_ip")
+			}
+		})
+	}
+}
+
+func TestRequestLoggerRendersErrorOnce(t *testing.T) {
+	rendered := 0
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		rendered++
+		apierror.HTTPErrorHandler(err, c)
+	}
+	e.Use(RequestLogger(logging.New(&bytes.Buffer{}, logging.LevelInfo)))
+
+	// The middleware inside RequestLogger sees the error before it is rendered.
+	var observed []string
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			status := Status(c, err)
+			observed = append(observed, strconv.Itoa(status)+" "+Route(c, status))
+			return err
+		}
+	})
+	e.GET("/expenses/:id", func(c echo.Context) error {
+		return apierror.New(http.StatusNotFound, apierror.CodeExpenseNotFound, "expense not found with given id")
+	})
+
+	for _, path := range []string{"/expenses/1", "/nowhere"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	}
+	assert.Equal(t, 2, rendered)
+	assert.Equal(t, []string{"404 /expenses/:id", "404 " + Unmatched}, observed)
+}
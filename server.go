@@ -2,38 +2,166 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	echomw "github.com/labstack/echo/v4/middleware"
+	"github.com/teerit/assessment/apierror"
+	"github.com/teerit/assessment/auth"
+	"github.com/teerit/assessment/config"
 	"github.com/teerit/assessment/db"
 	"github.com/teerit/assessment/expense"
+	"github.com/teerit/assessment/health"
+	"github.com/teerit/assessment/logging"
+	"github.com/teerit/assessment/metrics"
 	"github.com/teerit/assessment/middleware"
+	"github.com/teerit/assessment/tracing"
 )
 
 func main() {
-	db, err := db.InitDB()
+	name, args := os.Args[0], os.Args[1:]
+	if len(args) > 0 && args[0] == "migrate" {
+		cfg, opts := loadConfig(name+" migrate", args[1:])
+		os.Exit(migrate(cfg, opts.Args))
+	}
+
+	cfg, opts := loadConfig(name, args)
+	if len(opts.Args) > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %q\n", opts.Args)
+		os.Exit(2)
+	}
+
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logger := logging.New(os.Stdout, level)
+	logging.Default = logger
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Exporter, cfg.Tracing.File)
+	if err != nil {
+		logger.Error("setting up tracing failed", "error", err)
+		os.Exit(1)
+	}
+
+	conn, err := db.Open(cfg.Database.URL)
+	if err != nil {
+		logger.Error("opening db failed", "error", err)
+		os.Exit(1)
+	}
+	conn.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	conn.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	conn.SetConnMaxLifetime(time.Duration(cfg.Database.ConnMaxLifetime))
+
+	checker, err := health.NewChecker(conn)
 	if err != nil {
-		fmt.Printf("Error initial db connection %s", err)
+		logger.Error("loading migrations failed", "error", err)
+		os.Exit(1)
 	}
+	checker.Timeout = time.Duration(cfg.Server.ReadyTimeout)
+
+	store, keys := expense.NewPostgresStore(conn), expense.NewPostgresIdempotencyStore(conn)
+	store.Timeout = time.Duration(cfg.Database.StatementTimeout)
+	keys.Timeout = time.Duration(cfg.Database.StatementTimeout)
+
+	// The database may come up after the server, so it is set up in the
+	// background while /readyz answers 503.
+	setupCtx, stopSetup := context.WithCancel(logging.NewContext(context.Background(), logger))
+	defer stopSetup()
+	go func() {
+		if err := db.Setup(setupCtx, conn, db.DefaultBackoff); err != nil {
+			if setupCtx.Err() != nil {
+				return
+			}
+			logger.Error("database setup abandoned", "error", err)
+			return
+		}
+		logger.Info("database is ready")
+		// Statements left unprepared here are prepared on first use.
+		if err := store.Prepare(setupCtx); err != nil && setupCtx.Err() == nil {
+			logger.Warn("preparing statements failed", "error", err)
+		}
+	}()
+
+	h := expense.ExpenseHandler(store)
+	h.Retention = time.Duration(cfg.Expenses.TrashRetention)
+	h.Keys = keys
+	h.KeyTTL = time.Duration(cfg.Expenses.IdempotencyTTL)
 
-	h := expense.ExpenseHandler(db)
 	e := echo.New()
+	e.HideBanner = true
+	e.HTTPErrorHandler = apierror.HTTPErrorHandler
+	e.JSONSerializer = tracing.JSONSerializer{}
 
-	e.Use(middleware.DateFormatAuthMiddleware)
-	e.Use(middleware.RequestLogger)
+	authenticators := []auth.Authenticator{}
+	if cfg.Auth.Mode != config.AuthJWT {
+		authenticators = append(authenticators, &auth.APIKeyAuthenticator{DB: conn})
+	}
+	if cfg.Auth.Mode != config.AuthAPIKey {
+		keys, err := auth.LoadKeySet(cfg.Auth.JWTKeysDir)
+		if err != nil {
+			logger.Error("loading jwt keys failed", "error", err)
+			os.Exit(1)
+		}
+		authenticators = append(authenticators, &auth.JWTAuthenticator{
+			Keys:     keys,
+			Issuer:   cfg.Auth.JWTIssuer,
+			Audience: cfg.Auth.JWTAudience,
+		})
+	}
 
-	e.POST("/expenses", h.CreateExpenseHandler)
-	e.GET("/expenses/:id", h.GetExpenseByIdHandler)
-	e.GET("/expenses", h.GetExpensesHandler)
-	e.PUT("/expenses/:id", h.UpdateExpenseHandler)
+	e.Use(middleware.RequestLogger(logger))
+	if len(cfg.CORS.AllowOrigins) > 0 {
+		e.Use(echomw.CORSWithConfig(echomw.CORSConfig{
+			AllowOrigins:  cfg.CORS.AllowOrigins,
+			AllowHeaders:  []string{echo.HeaderAuthorization, echo.HeaderContentType, "X-API-Key", "Idempotency-Key", "If-Match", middleware.HeaderRequestID},
+			ExposeHeaders: []string{"ETag", middleware.HeaderRequestID, "Idempotent-Replayed"},
+		}))
+	}
+	e.Use(tracing.Middleware)
+	e.Use(metrics.Middleware)
+
+	if err := metrics.RegisterDB(conn, "expenses"); err != nil {
+		logger.Error("registering db metrics failed", "error", err)
+	}
+	if cfg.Metrics.Token != "" {
+		e.GET("/metrics", metrics.Handler(cfg.Metrics.Token))
+	} else {
+		logger.Warn("metrics.token is not set, /metrics is disabled")
+	}
+
+	e.GET("/healthz", health.LiveHandler)
+	e.GET("/readyz", checker.ReadyHandler)
+
+	api := e.Group("", middleware.Authenticate(authenticators...))
+
+	api.POST("/expenses", h.CreateExpenseHandler)
+	api.GET("/expenses/:id", h.GetExpenseByIdHandler)
+	api.GET("/expenses", h.GetExpensesHandler)
+	api.PUT("/expenses/:id", h.UpdateExpenseHandler)
+	api.PATCH("/expenses/:id", h.PatchExpenseHandler)
+	api.DELETE("/expenses/:id", h.DeleteExpenseHandler)
+	api.GET("/expenses/summary", h.GetSummaryHandler)
+	api.GET("/expenses/search", h.SearchExpensesHandler)
+	api.GET("/expenses/export.csv", h.ExportCSVHandler)
+	api.POST("/expenses/import", h.ImportCSVHandler)
+	api.POST("/expenses\\:batch", h.BatchExpensesHandler)
+	api.GET("/expenses/trash", h.GetTrashHandler)
+	api.DELETE("/expenses/trash", h.PurgeTrashHandler)
+	api.POST("/expenses/:id/restore", h.RestoreExpenseHandler)
 
 	// Start server
 	go func() {
-		fmt.Println(e.Start(":" + os.Getenv("PORT")))
+		addr := ":" + strconv.Itoa(cfg.Server.Port)
+		if cfg.TLS.Enabled() {
+			logger.Info("server stopped", "reason", e.StartTLS(addr, cfg.TLS.CertFile, cfg.TLS.KeyFile))
+		} else {
+			logger.Info("server stopped", "reason", e.Start(addr))
+		}
 	}()
 
 	// Gracefully Shutdown
@@ -44,18 +172,119 @@ func main() {
 
 	<-gracefulStop
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
 	defer cancel()
 
 	if err := e.Shutdown(ctx); err != nil {
-		fmt.Printf("Error shutting down server %s", err)
+		logger.Error("shutting down server failed", "error", err)
 	} else {
-		fmt.Println("Server gracefully stopped")
+		logger.Info("server gracefully stopped")
 	}
 
-	if err := h.DB.Close(); err != nil {
-		fmt.Printf("Error closing db connection %s", err)
+	stopSetup()
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("flushing traces failed", "error", err)
+	}
+	store.Close()
+	keys.Close()
+	if err := conn.Close(); err != nil {
+		logger.Error("closing db connection failed", "error", err)
 	} else {
-		fmt.Println("DB connection gracefully closed")
+		logger.Info("db connection gracefully closed")
+	}
+}
+
+// loadConfig loads the config for a command line, exiting on errors and for
+// -help and -print-config.
+func loadConfig(name string, args []string) (*config.Config, config.Options) {
+	cfg, opts, err := config.Load(name, args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		config.Usage(os.Stdout, name)
+		os.Exit(0)
+	}
+	if opts.PrintConfig && cfg != nil {
+		cfg.Print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if cfg == nil {
+			config.Usage(os.Stderr, name)
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+	if opts.PrintConfig {
+		os.Exit(0)
+	}
+	return cfg, opts
+}
+
+// migrate runs the "migrate up|down [steps]|status" subcommand.
+func migrate(cfg *config.Config, args []string) int {
+	conn, err := db.Open(cfg.Database.URL)
+	if err != nil {
+		fmt.Printf("Error initial db connection %s\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	m, err := db.NewMigrator(conn)
+	if err != nil {
+		fmt.Printf("Error loading migrations %s\n", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	switch cmd {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, mig := range applied {
+			fmt.Printf("Applied migration v%d__%s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			fmt.Printf("Error migrating up %s\n", err)
+			return 1
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				fmt.Println("Usage: migrate down [steps]")
+				return 2
+			}
+		}
+		reverted, err := m.Down(ctx, steps)
+		for _, mig := range reverted {
+			fmt.Printf("Reverted migration v%d__%s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			fmt.Printf("Error migrating down %s\n", err)
+			return 1
+		}
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			fmt.Printf("Error reading migration status %s\n", err)
+			return 1
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			if s.Modified {
+				state += " (modified)"
+			}
+			fmt.Printf("v%d__%s\t%s\n", s.Version, s.Name, state)
+		}
+	default:
+		fmt.Println("Usage: migrate up|down [steps]|status")
+		return 2
 	}
+	return 0
 }
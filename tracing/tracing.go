@@ -0,0 +1,148 @@
+// Package tracing sets up OpenTelemetry tracing and traces HTTP requests.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo/v4"
+	"github.com/teerit/assessment/logging"
+	"github.com/teerit/assessment/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName identifies the API in exported spans.
+const ServiceName = "expenses-api"
+
+// InstrumentationName names the tracer of this module.
+const InstrumentationName = "github.com/teerit/assessment"
+
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Tracer returns the tracer the API's spans are started with.
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// Setup installs the global tracer provider and the W3C trace context and
+// baggage propagators. exporter is one of the Exporter constants; the file
+// exporter writes to path. The OTLP exporter is configured by the standard
+// OTEL_EXPORTER_OTLP_* variables. The returned function flushes pending spans
+// and must be called before exiting.
+func Setup(ctx context.Context, exporter, path string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		if path == "" {
+			return nil, fmt.Errorf("the %s trace exporter needs a file path", ExporterFile)
+		}
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			return nil, err
+		}
+		closer = f
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, want %s, %s, %s or %s", exporter, ExporterNone, ExporterOTLP, ExporterStdout, ExporterFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Middleware starts a server span for every request, continuing the trace of
+// an incoming traceparent header, and puts it on the request context. Handler
+// logs carry its trace id. The span is named after the route template once the
+// request is done.
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := Tracer().Start(ctx, req.Method, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		if sc := span.SpanContext(); sc.IsValid() {
+			ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("trace_id", sc.TraceID().String()))
+		}
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+
+		status := middleware.Status(c, err)
+		route := middleware.Route(c, status)
+		span.SetName(req.Method + " " + route)
+		span.SetAttributes(
+			semconv.HTTPMethod(req.Method),
+			semconv.HTTPRoute(route),
+			semconv.HTTPStatusCode(status),
+		)
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+			if err != nil {
+				span.RecordError(err)
+			}
+		}
+		return err
+	}
+}
+
+// JSONSerializer times the encoding of JSON responses in a span of its own,
+// so slow encoding can be told apart from slow handlers and queries.
+type JSONSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (s JSONSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	_, span := Tracer().Start(c.Request().Context(), "json.encode")
+	defer span.End()
+
+	err := s.DefaultJSONSerializer.Serialize(c, i, indent)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+//go:build unit
+// +build unit
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// record installs a tracer provider that keeps every finished span.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return sr
+}
+
+func attrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	m := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestMiddleware(t *testing.T) {
+	sr := record(t)
+	e := echo.New()
+	e.JSONSerializer = JSONSerializer{}
+	e.Use(Middleware)
+	e.GET("/expenses/:id", func(c echo.Context) error {
+		if c.Param("id") == "0" {
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		return c.JSON(http.StatusOK, map[string]int{"id": 1})
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/expenses/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/expenses/0", nil))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+
+	// Error responses are encoded too, but only once the error has left the
+	// middleware, so their encode span ends after the request's.
+	spans := sr.Ended()
+	if !assert.Len(t, spans, 6) {
+		return
+	}
+
+	encode, ok := spans[0], spans[1]
+	assert.Equal(t, "json.encode", encode.Name())
+	assert.Equal(t, ok.SpanContext().SpanID(), encode.Parent().SpanID())
+
+	assert.Equal(t, "GET /expenses/:id", ok.Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", ok.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", ok.Parent().SpanID().String())
+	assert.True(t, ok.Parent().IsRemote())
+	assert.Equal(t, int64(200), attrs(ok)["http.status_code"].AsInt64())
+	assert.Equal(t, "/expenses/:id", attrs(ok)["http.route"].AsString())
+	assert.Equal(t, codes.Unset, ok.Status().Code)
+
+	failed := spans[2]
+	assert.False(t, failed.Parent().IsValid())
+	assert.Equal(t, codes.Error, failed.Status().Code)
+	assert.Equal(t, int64(500), attrs(failed)["http.status_code"].AsInt64())
+	assert.Equal(t, "json.encode", spans[3].Name())
+
+	assert.Equal(t, "GET unmatched", spans[4].Name())
+	assert.Equal(t, int64(404), attrs(spans[4])["http.status_code"].AsInt64())
+}
+
+func TestSetup(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	_, err := Setup(context.Background(), "zipkin", "")
+	assert.Error(t, err)
+	_, err = Setup(context.Background(), ExporterFile, "")
+	assert.Error(t, err)
+
+	shutdown, err := Setup(context.Background(), ExporterNone, "")
+	if assert.NoError(t, err) {
+		assert.NoError(t, shutdown(context.Background()))
+	}
+
+	path := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err = Setup(context.Background(), ExporterFile, path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, span := Tracer().Start(context.Background(), "offline")
+	span.End()
+	assert.NoError(t, shutdown(context.Background()))
+
+	b, err := os.ReadFile(path)
+	if assert.NoError(t, err) {
+		assert.True(t, strings.Contains(string(b), `"Name":"offline"`), string(b))
+		assert.True(t, strings.Contains(string(b), ServiceName), string(b))
+	}
+}
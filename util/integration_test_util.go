@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 )
 
@@ -22,9 +23,9 @@ func Uri(paths ...string) string {
 
 func Request(method, url string, body io.Reader) *Response {
 	req, _ := http.NewRequest(method, url, body)
-	// token := os.Getenv("AUTH_TOKEN")
-	token := "November 10, 2009"
-	req.Header.Add("Authorization", token)
+	if token := os.Getenv("AUTH_TOKEN"); token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
 	req.Header.Add("Content-Type", "application/json")
 	client := http.Client{}
 	res, err := client.Do(req)